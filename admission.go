@@ -0,0 +1,75 @@
+package tunat
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// passthroughDialTimeout give up dialing the original destination of a
+// passthrough flow after it
+const passthroughDialTimeout = 30 * time.Second
+
+// Flow a new TCP flow, seen on its first SYN
+type Flow struct {
+	// Source original source address
+	Source netip.AddrPort
+	// Destination original destination address
+	Destination netip.AddrPort
+	// Interface name of the tun device, empty unless Options.DeviceName is set
+	Interface string
+}
+
+// AdmissionPolicy decide a new TCP flow before its nat map is created,
+// ActionAccept, ActionReject, ActionDrop or ActionPassthrough
+type AdmissionPolicy func(flow Flow) Action
+
+// Dialer dial the original destination of passthrough flows, *net.Dialer
+// satisfies it
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// passthrough relay conn to its original destination until either side
+// finishes or Tunat is closed
+func (t *Tunat) passthrough(conn *tcpConn) {
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), passthroughDialTimeout)
+	remote, err := t.dialer.DialContext(ctx, "tcp", conn.daddr.String())
+	cancel()
+	if err != nil {
+		t.logger.Printf("tunat passthrough %v: %v", conn.daddr, err)
+		return
+	}
+	defer remote.Close()
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-t.closed:
+			conn.Close()
+			remote.Close()
+		case <-finished:
+		}
+	}()
+
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(remote, conn.Conn)
+		closeWrite(remote)
+		errChan <- err
+	}()
+	_, _ = io.Copy(conn.Conn, remote)
+	closeWrite(conn.Conn)
+	<-errChan
+}
+
+func closeWrite(conn net.Conn) {
+	if conn, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = conn.CloseWrite()
+	}
+}
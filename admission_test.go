@@ -0,0 +1,91 @@
+package tunat
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+func TestAdmissionPolicy(t *testing.T) {
+	var flows []Flow
+	tn, dev := newTunatWithOptions(t, WithAdmissionPolicy(func(flow Flow) Action {
+		flows = append(flows, flow)
+		return Action(flow.Destination.Port())
+	}))
+	saddr := netip.MustParseAddrPort("10.0.0.1:1234")
+	daddr := func(action Action) netip.AddrPort {
+		return netip.AddrPortFrom(netip.MustParseAddr("1.2.3.4"), uint16(action))
+	}
+
+	// dropped and rejected flows get no nat map
+	_, _ = dev.Write(buildTCP(saddr, daddr(ActionDrop), header.TCPFlagSyn, nil))
+	_, _ = dev.Write(buildTCP(saddr, daddr(ActionReject), header.TCPFlagSyn, nil))
+	resetSaddr, _, tcpHeader := parseTCP(t, readPacket(t, dev))
+	if resetSaddr != daddr(ActionReject) || tcpHeader.Flags() != header.TCPFlagRst|header.TCPFlagAck {
+		t.Fatalf("reset from %v flags %v", resetSaddr, tcpHeader.Flags())
+	}
+	if tn.ipv4NAT.len() != 0 {
+		t.Fatal("nat map created")
+	}
+
+	for _, action := range []Action{ActionAccept, ActionPassthrough} {
+		saddr := netip.AddrPortFrom(saddr.Addr(), 2000+uint16(action))
+		_, _ = dev.Write(buildTCP(saddr, daddr(action), header.TCPFlagSyn, nil))
+		fakeAddr, listenerAddr, _ := parseTCP(t, readPacket(t, dev))
+		if listenerAddr != tn.ipv4TCPListenerAddrPort {
+			t.Fatalf("syn rewritten to %v", listenerAddr)
+		}
+		_, natDaddr, passthrough, _ := tn.lookupTCP(fakeAddr)
+		if natDaddr != daddr(action) || passthrough != (action == ActionPassthrough) {
+			t.Fatalf("%v passthrough %v", natDaddr, passthrough)
+		}
+	}
+
+	// later packets of a flow do not ask again
+	_, _ = dev.Write(buildTCP(netip.AddrPortFrom(saddr.Addr(), 2000+uint16(ActionPassthrough)), daddr(ActionPassthrough), header.TCPFlagAck, nil))
+	readPacket(t, dev)
+	if len(flows) != 4 || flows[0].Source != saddr || flows[0].Destination != daddr(ActionDrop) {
+		t.Fatalf("flows %v", flows)
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	tn, _ := newTestTunat(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	go tn.passthrough(&tcpConn{
+		Conn:  remote,
+		tunat: tn,
+		daddr: listener.Addr().(*net.TCPAddr).AddrPort(),
+	})
+
+	_, _ = local.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(local, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("%q %v", buf, err)
+	}
+
+	// Close stops the relay
+	tn.Close()
+	if _, err := local.Read(buf); err != io.EOF {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,37 @@
+package tunat
+
+import "sync"
+
+// bufferPool buffers of one size, larger buffers are allocated and never
+// pooled
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	p := &bufferPool{size: size}
+	p.pool.New = func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return p
+}
+
+// get a buffer of length size, its content is undefined
+func (p *bufferPool) get(size int) *[]byte {
+	if size > p.size {
+		buf := make([]byte, size)
+		return &buf
+	}
+	buf := p.pool.Get().(*[]byte)
+	*buf = (*buf)[:size]
+	return buf
+}
+
+func (p *bufferPool) put(buf *[]byte) {
+	if buf == nil || cap(*buf) != p.size {
+		return
+	}
+	p.pool.Put(buf)
+}
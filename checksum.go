@@ -0,0 +1,79 @@
+package tunat
+
+import (
+	"encoding/binary"
+	"net/netip"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// offsets of the address fields
+const (
+	ipv4SourceOffset      = 12
+	ipv4DestinationOffset = ipv4SourceOffset + header.IPv4AddressSize
+	ipv6SourceOffset      = 8
+	ipv6DestinationOffset = ipv6SourceOffset + header.IPv6AddressSize
+)
+
+// checksumUpdate adjust checksum for a field changed from old to new, as RFC
+// 1624 eqn. 3: HC' = ~(~HC + ~m + m'). The field must start at an even
+// offset and old and new must have the same even length
+func checksumUpdate(checksum uint16, old, new []byte) uint16 {
+	sum := uint32(^checksum)
+	for i := 0; i+1 < len(old); i += 2 {
+		sum += uint32(^binary.BigEndian.Uint16(old[i:]))
+		sum += uint32(binary.BigEndian.Uint16(new[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// rewriteIPv4TCP set the addresses and ports of a TCP segment, the checksums
+// are adjusted instead of summing the payload again. A partial TCP checksum
+// of an offloaded segment only covers the pseudo header
+func rewriteIPv4TCP(ipHeader header.IPv4, tcpHeader header.TCP, saddr, daddr netip.AddrPort, partial bool) {
+	src, dst := saddr.Addr().Unmap().As4(), daddr.Addr().Unmap().As4()
+	srcField := ipHeader[ipv4SourceOffset:ipv4DestinationOffset]
+	dstField := ipHeader[ipv4DestinationOffset : ipv4DestinationOffset+header.IPv4AddressSize]
+
+	checksum := checksumUpdate(ipHeader.Checksum(), srcField, src[:])
+	ipHeader.SetChecksum(checksumUpdate(checksum, dstField, dst[:]))
+	rewriteTCP(tcpHeader, srcField, dstField, src[:], dst[:], saddr.Port(), daddr.Port(), partial)
+}
+
+// rewriteIPv6TCP like rewriteIPv4TCP, ipv6 has no header checksum
+func rewriteIPv6TCP(ipHeader header.IPv6, tcpHeader header.TCP, saddr, daddr netip.AddrPort, partial bool) {
+	src, dst := saddr.Addr().As16(), daddr.Addr().As16()
+	rewriteTCP(tcpHeader,
+		ipHeader[ipv6SourceOffset:ipv6DestinationOffset],
+		ipHeader[ipv6DestinationOffset:header.IPv6MinimumSize],
+		src[:], dst[:], saddr.Port(), daddr.Port(), partial,
+	)
+}
+
+// rewriteTCP srcField and dstField are the address fields of the ip header,
+// both in the pseudo header of the TCP checksum
+func rewriteTCP(tcpHeader header.TCP, srcField, dstField, src, dst []byte, sport, dport uint16, partial bool) {
+	var ports [4]byte
+	binary.BigEndian.PutUint16(ports[:], sport)
+	binary.BigEndian.PutUint16(ports[2:], dport)
+
+	// a partial checksum is a sum, not its complement
+	checksum := tcpHeader.Checksum()
+	if partial {
+		checksum = ^checksum
+	}
+	checksum = checksumUpdate(checksum, srcField, src)
+	checksum = checksumUpdate(checksum, dstField, dst)
+	if partial {
+		checksum = ^checksum
+	} else {
+		checksum = checksumUpdate(checksum, tcpHeader[:len(ports)], ports[:])
+	}
+	copy(srcField, src)
+	copy(dstField, dst)
+	copy(tcpHeader, ports[:])
+	tcpHeader.SetChecksum(checksum)
+}
@@ -0,0 +1,115 @@
+package tunat
+
+import (
+	"math/rand"
+	"net/netip"
+	"strconv"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// fullChecksum recompute the checksums of a TCP packet from scratch
+func fullChecksum(packet []byte) {
+	var src, dst tcpip.Address
+	var tcpHeader header.TCP
+	if header.IPVersion(packet) == header.IPv4Version {
+		ipHeader := header.IPv4(packet)
+		ipHeader.SetChecksum(0)
+		ipHeader.SetChecksum(^ipHeader.CalculateChecksum())
+		src, dst, tcpHeader = ipHeader.SourceAddress(), ipHeader.DestinationAddress(), ipHeader.Payload()
+	} else {
+		ipHeader := header.IPv6(packet)
+		src, dst, tcpHeader = ipHeader.SourceAddress(), ipHeader.DestinationAddress(), ipHeader.Payload()
+	}
+	tcpHeader.SetChecksum(0)
+	tcpHeader.SetChecksum(^tcpHeader.CalculateChecksum(header.Checksum(
+		tcpHeader.Payload(),
+		header.PseudoHeaderChecksum(header.TCPProtocolNumber, src, dst, uint16(len(tcpHeader))),
+	)))
+}
+
+// randomAddrPort an address of the same family as addr
+func randomAddrPort(random *rand.Rand, addr netip.Addr) netip.AddrPort {
+	ip := make([]byte, addr.BitLen()/8)
+	random.Read(ip)
+	addr, _ = netip.AddrFromSlice(ip)
+	return netip.AddrPortFrom(addr, uint16(random.Intn(1<<16)))
+}
+
+func TestChecksumUpdate(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 10000; i++ {
+		saddr := randomAddrPort(random, netip.IPv4Unspecified())
+		daddr := randomAddrPort(random, netip.IPv4Unspecified())
+		if i%2 == 1 {
+			saddr = randomAddrPort(random, netip.IPv6Unspecified())
+			daddr = randomAddrPort(random, netip.IPv6Unspecified())
+		}
+		payload := make([]byte, random.Intn(64))
+		random.Read(payload)
+		packet := buildTCP(saddr, daddr, header.TCPFlagAck, payload)
+
+		natSaddr := randomAddrPort(random, saddr.Addr())
+		natDaddr := randomAddrPort(random, daddr.Addr())
+		if saddr.Addr().Is4() {
+			ipHeader := header.IPv4(packet)
+			rewriteIPv4TCP(ipHeader, ipHeader.Payload(), natSaddr, natDaddr, false)
+		} else {
+			ipHeader := header.IPv6(packet)
+			rewriteIPv6TCP(ipHeader, ipHeader.Payload(), natSaddr, natDaddr, false)
+		}
+		want := append([]byte(nil), packet...)
+		fullChecksum(want)
+		if string(packet) != string(want) {
+			t.Fatalf("%v -> %v rewritten to %v -> %v:\n%x\nwant\n%x", saddr, daddr, natSaddr, natDaddr, packet, want)
+		}
+	}
+}
+
+func benchmarkRewrite(b *testing.B, size int, rewrite func(packet header.IPv4)) {
+	packet := header.IPv4(buildTCP(
+		netip.MustParseAddrPort("10.0.0.1:1234"),
+		netip.MustParseAddrPort("1.2.3.4:80"),
+		header.TCPFlagAck,
+		make([]byte, size-header.IPv4MinimumSize-header.TCPMinimumSize),
+	))
+
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rewrite(packet)
+	}
+}
+
+func BenchmarkRewriteIncremental(b *testing.B) {
+	natSaddr := netip.MustParseAddrPort("10.0.0.2:1234")
+	natDaddr := netip.MustParseAddrPort("10.0.0.1:100")
+	for _, size := range []int{1500, 65535} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			benchmarkRewrite(b, size, func(packet header.IPv4) {
+				rewriteIPv4TCP(packet, packet.Payload(), natSaddr, natDaddr, false)
+			})
+		})
+	}
+}
+
+func BenchmarkRewriteFull(b *testing.B) {
+	natSaddr := tcpip.Address(netip.MustParseAddr("10.0.0.2").AsSlice())
+	natDaddr := tcpip.Address(netip.MustParseAddr("10.0.0.1").AsSlice())
+	for _, size := range []int{1500, 65535} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			benchmarkRewrite(b, size, func(packet header.IPv4) {
+				packet.SetSourceAddress(natSaddr)
+				packet.SetDestinationAddress(natDaddr)
+				tcpHeader := header.TCP(packet.Payload())
+				tcpHeader.SetSourcePort(1234)
+				tcpHeader.SetDestinationPort(100)
+				fullChecksum(packet)
+			})
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package tunat
+
+import (
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// TCPTimeouts idle timeouts of tcp nat map entries, by connection state
+type TCPTimeouts struct {
+	// SynSent before the handshake completes
+	SynSent time.Duration
+	// Established after the handshake completes
+	Established time.Duration
+	// FinWait after one side sent FIN
+	FinWait time.Duration
+	// TimeWait after both sides sent FIN
+	TimeWait time.Duration
+	// Close after RST
+	Close time.Duration
+}
+
+// DefaultTCPTimeouts close to the linux nf_conntrack defaults, except a
+// shorter Established
+var DefaultTCPTimeouts = TCPTimeouts{
+	SynSent:     2 * time.Minute,
+	Established: 24 * time.Hour,
+	FinWait:     2 * time.Minute,
+	TimeWait:    2 * time.Minute,
+	Close:       10 * time.Second,
+}
+
+const conntrackGCInterval = 10 * time.Second
+
+type tcpState uint8
+
+const (
+	tcpStateSynSent tcpState = iota
+	tcpStateSynReceived
+	tcpStateEstablished
+	tcpStateFinWait
+	tcpStateTimeWait
+	tcpStateClose
+)
+
+const (
+	finFromClient uint8 = 1 << iota
+	finFromListener
+)
+
+// conntrack state of one NAT'd connection, protected by the natShard lock
+type conntrack struct {
+	state    tcpState
+	fin      uint8
+	lastSeen time.Time
+}
+
+func newConntrack(now time.Time) conntrack {
+	return conntrack{
+		state:    tcpStateSynSent,
+		lastSeen: now,
+	}
+}
+
+// update follow the flags of a packet, fromClient means the packet is sent
+// by the original source rather than the listener
+func (c *conntrack) update(flags header.TCPFlags, fromClient bool, now time.Time) {
+	c.lastSeen = now
+	switch {
+	case flags&header.TCPFlagRst != 0:
+		c.state = tcpStateClose
+	case c.state == tcpStateClose:
+	case flags&header.TCPFlagFin != 0:
+		if fromClient {
+			c.fin |= finFromClient
+		} else {
+			c.fin |= finFromListener
+		}
+		if c.fin == finFromClient|finFromListener {
+			c.state = tcpStateTimeWait
+		} else {
+			c.state = tcpStateFinWait
+		}
+	case c.state == tcpStateSynSent && !fromClient && flags&header.TCPFlagSyn != 0 && flags&header.TCPFlagAck != 0:
+		c.state = tcpStateSynReceived
+	case c.state == tcpStateSynReceived && fromClient && flags&header.TCPFlagAck != 0:
+		c.state = tcpStateEstablished
+	}
+}
+
+// reusable a new SYN from the same source may replace this connection
+func (c *conntrack) reusable() bool {
+	return c.state == tcpStateTimeWait || c.state == tcpStateClose
+}
+
+func (c *conntrack) expired(now time.Time, timeouts *TCPTimeouts) bool {
+	var timeout time.Duration
+	switch c.state {
+	case tcpStateSynSent, tcpStateSynReceived:
+		timeout = timeouts.SynSent
+	case tcpStateEstablished:
+		timeout = timeouts.Established
+	case tcpStateFinWait:
+		timeout = timeouts.FinWait
+	case tcpStateTimeWait:
+		timeout = timeouts.TimeWait
+	default:
+		timeout = timeouts.Close
+	}
+	return now.Sub(c.lastSeen) > timeout
+}
+
+// gcLoop remove expired entries and sessions in the background until Close
+func (t *Tunat) gcLoop() {
+	ticker := time.NewTicker(conntrackGCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			t.gcTCP(now)
+			t.gcUDP(now)
+			t.gcFragments(now)
+		case <-t.closed:
+			return
+		}
+	}
+}
+
+func (t *Tunat) gcTCP(now time.Time) {
+	if t.ipv4NAT != nil {
+		t.ipv4NAT.gc(now, &t.tcpTimeouts)
+	}
+	if t.ipv6NAT != nil {
+		t.ipv6NAT.gc(now, &t.tcpTimeouts)
+	}
+}
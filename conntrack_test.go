@@ -0,0 +1,69 @@
+package tunat
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+func TestConntrack(t *testing.T) {
+	saddr := netip.MustParseAddrPort("10.0.0.1:1234")
+	daddr := netip.MustParseAddrPort("1.2.3.4:80")
+
+	for _, tt := range []struct {
+		name    string
+		packets []header.TCPFlags // odd indexes are sent by the listener
+		after   time.Duration
+		exist   bool
+	}{
+		{"syn sent", []header.TCPFlags{header.TCPFlagSyn}, time.Minute, true},
+		{"syn sent expired", []header.TCPFlags{header.TCPFlagSyn}, 3 * time.Minute, false},
+		{"established", []header.TCPFlags{header.TCPFlagSyn, header.TCPFlagSyn | header.TCPFlagAck, header.TCPFlagAck}, time.Hour, true},
+		{"fin wait expired", []header.TCPFlags{header.TCPFlagSyn, header.TCPFlagSyn | header.TCPFlagAck, header.TCPFlagAck, header.TCPFlagFin | header.TCPFlagAck}, 3 * time.Minute, false},
+		{"rst", []header.TCPFlags{header.TCPFlagSyn, header.TCPFlagRst | header.TCPFlagAck}, time.Minute, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tn, dev := newTestTunat(t)
+
+			var fakeAddr netip.AddrPort
+			for i, flags := range tt.packets {
+				if i%2 == 0 {
+					_, _ = dev.Write(buildTCP(saddr, daddr, flags, nil))
+				} else {
+					_, _ = dev.Write(buildTCP(tn.ipv4TCPListenerAddrPort, fakeAddr, flags, nil))
+				}
+				packet := readPacket(t, dev)
+				if i == 0 {
+					fakeAddr, _, _ = parseTCP(t, packet)
+				}
+			}
+
+			tn.gcTCP(time.Now().Add(tt.after))
+			_, _, _, ok := tn.lookupTCP(fakeAddr)
+			if ok != tt.exist || (tn.ipv4NAT.len() == 1) != tt.exist {
+				t.Fatalf("want exist %v, got %v %v", tt.exist, ok, tn.ipv4NAT.len())
+			}
+		})
+	}
+}
+
+func TestConntrackReuse(t *testing.T) {
+	tn, dev := newTestTunat(t)
+	saddr := netip.MustParseAddrPort("10.0.0.1:1234")
+
+	_, _ = dev.Write(buildTCP(saddr, netip.MustParseAddrPort("1.2.3.4:80"), header.TCPFlagSyn, nil))
+	fakeAddr, _, _ := parseTCP(t, readPacket(t, dev))
+	_, _ = dev.Write(buildTCP(saddr, netip.MustParseAddrPort("1.2.3.4:80"), header.TCPFlagRst, nil))
+	readPacket(t, dev)
+
+	_, _ = dev.Write(buildTCP(saddr, netip.MustParseAddrPort("5.6.7.8:80"), header.TCPFlagSyn, nil))
+	newFakeAddr, _, _ := parseTCP(t, readPacket(t, dev))
+	if _, daddr, _, _ := tn.lookupTCP(newFakeAddr); daddr != netip.MustParseAddrPort("5.6.7.8:80") {
+		t.Fatalf("nat map not replaced: %v", daddr)
+	}
+	if _, _, _, ok := tn.lookupTCP(fakeAddr); ok && fakeAddr != newFakeAddr {
+		t.Fatalf("old nat map still exist: %v", fakeAddr)
+	}
+}
@@ -0,0 +1,9 @@
+package device
+
+import "io"
+
+// Device tun device, every Read and Write carries exactly one IP packet.
+// Close must make a blocked Read return, an *os.File must be non-blocking
+type Device interface {
+	io.ReadWriteCloser
+}
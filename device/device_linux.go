@@ -17,6 +17,137 @@ type ifreq struct {
 
 // New an issue https://github.com/golang/go/issues/30426#issuecomment-470335255
 func New(name string) (file *os.File, err error) {
+	return open(name, syscall.IFF_TUN|syscall.IFF_NO_PI)
+}
+
+// NewMultiQueue open queues queues of one tun device, packets of a flow are
+// always read from the same queue
+func NewMultiQueue(name string, queues int) (files []*os.File, err error) {
+	return openQueues(name, queues, syscall.IFF_TUN|syscall.IFF_NO_PI|unix.IFF_MULTI_QUEUE)
+}
+
+// tun offload flags of TUNSETOFFLOAD
+const (
+	tunFCsum = 0x01
+	tunFTSO4 = 0x02
+	tunFTSO6 = 0x04
+	tunFUSO4 = 0x20
+	tunFUSO6 = 0x40
+)
+
+type offloadFile struct {
+	*os.File
+	rawConn syscall.RawConn
+}
+
+// NewOffload like NewMultiQueue, with IFF_VNET_HDR and checksum, TSO and USO
+// offload, USO is left out on kernels without it. One queue is opened
+// without IFF_MULTI_QUEUE
+func NewOffload(name string, queues int) (devices []OffloadDevice, err error) {
+	flags := uint16(syscall.IFF_TUN | syscall.IFF_NO_PI | unix.IFF_VNET_HDR)
+	if queues > 1 {
+		flags |= unix.IFF_MULTI_QUEUE
+	}
+	files, err := openQueues(name, queues, flags)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		rawConn, err := file.SyscallConn()
+		if err != nil {
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, err
+		}
+		devices = append(devices, &offloadFile{File: file, rawConn: rawConn})
+	}
+	return
+}
+
+func setOffload(fd int) error {
+	err := unix.IoctlSetInt(fd, unix.TUNSETOFFLOAD, tunFCsum|tunFTSO4|tunFTSO6|tunFUSO4|tunFUSO6)
+	if err == unix.EINVAL {
+		err = unix.IoctlSetInt(fd, unix.TUNSETOFFLOAD, tunFCsum|tunFTSO4|tunFTSO6)
+	}
+	return err
+}
+
+// ReadOffload buf should hold 65535 bytes, GSO packets are truncated otherwise
+func (f *offloadFile) ReadOffload(buf []byte) (hdr VirtioNetHdr, nread int, err error) {
+	var hdrBuf [VirtioNetHdrLen]byte
+	var readErr error
+	err = f.rawConn.Read(func(fd uintptr) bool {
+		nread, readErr = unix.Readv(int(fd), [][]byte{hdrBuf[:], buf})
+		return readErr != unix.EAGAIN
+	})
+	if err == nil {
+		err = readErr
+	}
+	if err != nil {
+		return hdr, 0, err
+	}
+	if nread < VirtioNetHdrLen {
+		return hdr, 0, errors.New("short virtio_net_hdr")
+	}
+	hdr.Decode(hdrBuf[:])
+	return hdr, nread - VirtioNetHdrLen, nil
+}
+
+// WriteOffload implements OffloadDevice
+func (f *offloadFile) WriteOffload(hdr VirtioNetHdr, packet []byte) (nwrite int, err error) {
+	var hdrBuf [VirtioNetHdrLen]byte
+	hdr.Encode(hdrBuf[:])
+	var writeErr error
+	err = f.rawConn.Write(func(fd uintptr) bool {
+		nwrite, writeErr = unix.Writev(int(fd), [][]byte{hdrBuf[:], packet})
+		return writeErr != unix.EAGAIN
+	})
+	if err == nil {
+		err = writeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return nwrite - VirtioNetHdrLen, nil
+}
+
+// Read like tun without IFF_VNET_HDR, except GSO packets
+func (f *offloadFile) Read(buf []byte) (nread int, err error) {
+	hdr, nread, err := f.ReadOffload(buf)
+	if err != nil {
+		return
+	}
+	CompleteChecksum(hdr, buf[:nread])
+	return
+}
+
+// Write like tun without IFF_VNET_HDR
+func (f *offloadFile) Write(buf []byte) (nwrite int, err error) {
+	return f.WriteOffload(VirtioNetHdr{}, buf)
+}
+
+func openQueues(name string, queues int, flags uint16) (files []*os.File, err error) {
+	defer func() {
+		if err != nil {
+			for _, file := range files {
+				file.Close()
+			}
+			files = nil
+		}
+	}()
+
+	for i := 0; i < queues; i++ {
+		file, err := open(name, flags)
+		if err != nil {
+			return files, err
+		}
+		files = append(files, file)
+	}
+	return
+}
+
+func open(name string, flags uint16) (file *os.File, err error) {
 	var tunPath string
 	if _, err = os.Stat("/dev/net/tun"); err == nil {
 		tunPath = "/dev/net/tun"
@@ -33,7 +164,7 @@ func New(name string) (file *os.File, err error) {
 
 	var req ifreq
 	copy(req.ifrName[:], []byte(name))
-	req.ifrFlags = syscall.IFF_TUN | syscall.IFF_NO_PI
+	req.ifrFlags = flags
 
 	_, _, errno := unix.Syscall(
 		syscall.SYS_IOCTL,
@@ -42,8 +173,15 @@ func New(name string) (file *os.File, err error) {
 		uintptr(unsafe.Pointer(&req)),
 	)
 	if errno != 0 {
+		syscall.Close(fd)
 		return nil, errno
 	}
+	if flags&unix.IFF_VNET_HDR != 0 {
+		if err = setOffload(fd); err != nil {
+			syscall.Close(fd)
+			return
+		}
+	}
 
 	file = os.NewFile(uintptr(fd), tunPath)
 	return
@@ -91,9 +229,17 @@ func NewFromUnixSocket(path string) (_ *os.File, err error) {
 
 	err = syscall.Unlink(path)
 	if err != nil {
+		syscall.Close(fds[0])
 		return
 	}
 
+	// fds of Android VpnService are blocking, Close would not interrupt a
+	// blocked Read without the poller
+	err = unix.SetNonblock(fds[0], true)
+	if err != nil {
+		syscall.Close(fds[0])
+		return
+	}
 	file := os.NewFile(uintptr(fds[0]), string(name[:nameLen]))
 	return file, nil
 }
@@ -3,7 +3,6 @@ package device
 import (
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"sync"
 
@@ -71,7 +70,7 @@ func (d *device) Close() (err error) {
 }
 
 // New create tun device
-func New(name string) (file io.ReadWriteCloser, err error) {
+func New(name string) (file Device, err error) {
 	if _, err = os.Stat("wintun.dll"); err != nil {
 		err = os.WriteFile("wintun.dll", wintunDLL, 0o777)
 		if err != nil {
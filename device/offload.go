@@ -0,0 +1,105 @@
+package device
+
+import (
+	"encoding/binary"
+	"unsafe"
+)
+
+// VirtioNetHdrLen length of struct virtio_net_hdr
+const VirtioNetHdrLen = 10
+
+// VirtioNetHdr flags
+const (
+	VirtioNetHdrFNeedsCsum uint8 = 1 // checksum at CsumStart+CsumOffset is partial
+	VirtioNetHdrFDataValid uint8 = 2
+)
+
+// VirtioNetHdr GSO types
+const (
+	GSONone  uint8 = 0
+	GSOTCPv4 uint8 = 1
+	GSOUDP   uint8 = 3
+	GSOTCPv6 uint8 = 4
+	GSOUDPL4 uint8 = 5
+	GSOECN   uint8 = 0x80
+)
+
+// VirtioNetHdr struct virtio_net_hdr, prefixed to every packet of a device
+// opened with IFF_VNET_HDR. A partial checksum holds the pseudo header sum,
+// not complemented. A GSO packet is a super-packet of segments of GSOSize
+// bytes payload
+type VirtioNetHdr struct {
+	Flags      uint8
+	GSOType    uint8
+	HdrLen     uint16
+	GSOSize    uint16
+	CsumStart  uint16
+	CsumOffset uint16
+}
+
+// nativeEndian byte order of the host, tun uses it for virtio_net_hdr unless
+// TUNSETVNETLE is set
+var nativeEndian = func() binary.ByteOrder {
+	one := uint16(1)
+	if *(*byte)(unsafe.Pointer(&one)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// Decode b is at least VirtioNetHdrLen bytes, in host byte order
+func (h *VirtioNetHdr) Decode(b []byte) {
+	h.Flags = b[0]
+	h.GSOType = b[1]
+	h.HdrLen = nativeEndian.Uint16(b[2:])
+	h.GSOSize = nativeEndian.Uint16(b[4:])
+	h.CsumStart = nativeEndian.Uint16(b[6:])
+	h.CsumOffset = nativeEndian.Uint16(b[8:])
+}
+
+// Encode like Decode
+func (h *VirtioNetHdr) Encode(b []byte) {
+	b[0] = h.Flags
+	b[1] = h.GSOType
+	nativeEndian.PutUint16(b[2:], h.HdrLen)
+	nativeEndian.PutUint16(b[4:], h.GSOSize)
+	nativeEndian.PutUint16(b[6:], h.CsumStart)
+	nativeEndian.PutUint16(b[8:], h.CsumOffset)
+}
+
+// OffloadDevice a device opened with IFF_VNET_HDR. Read and Write of Device
+// carry no virtio_net_hdr, Read completes partial checksums but still returns
+// GSO super-packets of up to 65535 bytes
+type OffloadDevice interface {
+	Device
+	// ReadOffload read one packet and its virtio_net_hdr
+	ReadOffload(buf []byte) (hdr VirtioNetHdr, nread int, err error)
+	// WriteOffload write one packet, the zero VirtioNetHdr means no offload
+	WriteOffload(hdr VirtioNetHdr, packet []byte) (nwrite int, err error)
+}
+
+// CompleteChecksum replace the partial checksum of packet with the full one
+func CompleteChecksum(hdr VirtioNetHdr, packet []byte) {
+	start, field := int(hdr.CsumStart), int(hdr.CsumStart)+int(hdr.CsumOffset)
+	if hdr.Flags&VirtioNetHdrFNeedsCsum == 0 || start > len(packet) || field+2 > len(packet) {
+		return
+	}
+
+	var sum uint32
+	data := packet[start:]
+	for len(data) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	}
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	checksum := ^uint16(sum)
+	if checksum == 0 {
+		checksum = 0xffff // 0 means no checksum in UDP, the same sum in TCP
+	}
+	binary.BigEndian.PutUint16(packet[field:], checksum)
+}
@@ -0,0 +1,58 @@
+package device
+
+import (
+	"os"
+	"sync"
+)
+
+type pipe struct {
+	rx        <-chan []byte
+	tx        chan<- []byte
+	closed    chan struct{}
+	closeOnce *sync.Once
+}
+
+// Pipe create a pair of in-memory devices, packets written to one end are
+// read from the other, closing either end closes both
+func Pipe() (Device, Device) {
+	ab := make(chan []byte, 64)
+	ba := make(chan []byte, 64)
+	closed := make(chan struct{})
+	closeOnce := &sync.Once{}
+	return &pipe{rx: ba, tx: ab, closed: closed, closeOnce: closeOnce},
+		&pipe{rx: ab, tx: ba, closed: closed, closeOnce: closeOnce}
+}
+
+// Read read one packet, truncated if buf is too small like tun
+func (p *pipe) Read(buf []byte) (int, error) {
+	select {
+	case packet := <-p.rx:
+		return copy(buf, packet), nil
+	case <-p.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+// Write write one packet
+func (p *pipe) Write(buf []byte) (int, error) {
+	select {
+	case <-p.closed:
+		return 0, os.ErrClosed
+	default:
+	}
+
+	select {
+	case p.tx <- append([]byte(nil), buf...):
+		return len(buf), nil
+	case <-p.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+// Close close both ends
+func (p *pipe) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+	return nil
+}
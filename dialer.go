@@ -0,0 +1,205 @@
+package tunat
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrLoop returned when the destination of an OutboundDialer would be routed
+// back into the tun device
+var ErrLoop = errors.New("tunat: destination loops back into the tun device")
+
+// loopCacheTimeout how long the route of a destination is trusted
+const loopCacheTimeout = 10 * time.Second
+
+// maxLoopCache number of destinations whose route is cached
+const maxLoopCache = 4096
+
+// OutboundDialer dial and listen for a proxy built on Tunat, the traffic of
+// its sockets does not enter the tun device again. Tunat.OutboundDialer
+// returns one matching the Options. The fields must not be modified once it
+// is used
+type OutboundDialer struct {
+	// Dialer timeouts, keep alive and local address of the dials
+	Dialer net.Dialer
+	// Mark SO_MARK of the sockets, such as Options.AutoRouteMark, linux only
+	Mark uint32
+	// Interface bind the sockets to this egress interface
+	Interface string
+	// LoopPrefixes refuse destinations inside them with ErrLoop
+	LoopPrefixes []netip.Prefix
+	// LoopDevice refuse destinations with ErrLoop if the sockets would be
+	// routed to this device, linux only
+	LoopDevice string
+
+	mutex      sync.Mutex
+	loopIndex  int // of LoopDevice, resolved on the first route lookup
+	bindIndex  int // of Interface
+	loopRoutes map[netip.Addr]loopRoute
+}
+
+type loopRoute struct {
+	loop    bool
+	expires time.Time
+}
+
+// Dial like net.Dial
+func (d *OutboundDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext like net.Dialer, the resolved destination is checked for loops
+// before connecting
+func (d *OutboundDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := d.Dialer
+	control := dialer.Control
+	dialer.Control = func(network, address string, c syscall.RawConn) (err error) {
+		if control != nil {
+			err = control(network, address, c)
+			if err != nil {
+				return
+			}
+		}
+		err = d.control(c)
+		if err != nil {
+			return
+		}
+		addrPort, err := netip.ParseAddrPort(address)
+		if err != nil {
+			return
+		}
+		return d.checkLoop(addrPort.Addr())
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// ListenPacket like net.ListenPacket for udp networks, the conn is an
+// *OutboundUDPConn
+func (d *OutboundDialer) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	listenConfig := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return d.control(c)
+		},
+	}
+	conn, err := listenConfig.ListenPacket(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &OutboundUDPConn{UDPConn: conn.(*net.UDPConn), dialer: d}, nil
+}
+
+// checkLoop addr inside LoopPrefixes or routed to LoopDevice, route lookups
+// are cached per destination
+func (d *OutboundDialer) checkLoop(addr netip.Addr) error {
+	addr = addr.Unmap()
+	for _, prefix := range d.LoopPrefixes {
+		if prefix.Contains(addr) {
+			return ErrLoop
+		}
+	}
+	if d.LoopDevice == "" {
+		return nil
+	}
+	if d.LoopDevice == d.Interface {
+		return ErrLoop
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	now := time.Now()
+	route, ok := d.loopRoutes[addr]
+	if !ok || now.After(route.expires) {
+		loop, err := d.routedToLoopDevice(addr)
+		if err != nil {
+			return err
+		}
+		if d.loopRoutes == nil || len(d.loopRoutes) >= maxLoopCache {
+			d.loopRoutes = make(map[netip.Addr]loopRoute)
+		}
+		route = loopRoute{loop: loop, expires: now.Add(loopCacheTimeout)}
+		d.loopRoutes[addr] = route
+	}
+	if route.loop {
+		return ErrLoop
+	}
+	return nil
+}
+
+// OutboundUDPConn a *net.UDPConn whose writes refuse destinations that loop
+// with ErrLoop
+type OutboundUDPConn struct {
+	*net.UDPConn
+	dialer *OutboundDialer
+}
+
+func (c *OutboundUDPConn) checkLoop(addr netip.Addr, netAddr net.Addr) error {
+	if err := c.dialer.checkLoop(addr); err != nil {
+		return &net.OpError{Op: "write", Net: c.LocalAddr().Network(), Source: c.LocalAddr(), Addr: netAddr, Err: err}
+	}
+	return nil
+}
+
+// WriteTo like net.UDPConn, addr is a *net.UDPAddr or any net.Addr whose
+// String is an ip:port
+func (c *OutboundUDPConn) WriteTo(payload []byte, addr net.Addr) (int, error) {
+	var daddr netip.AddrPort
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		daddr = udpAddr.AddrPort()
+	} else if addr != nil {
+		daddr, _ = netip.ParseAddrPort(addr.String())
+	}
+	if !daddr.IsValid() {
+		return 0, &net.OpError{Op: "write", Net: c.LocalAddr().Network(), Source: c.LocalAddr(), Addr: addr, Err: syscall.EINVAL}
+	}
+	return c.WriteToUDPAddrPort(payload, daddr)
+}
+
+// WriteToUDP like net.UDPConn
+func (c *OutboundUDPConn) WriteToUDP(payload []byte, addr *net.UDPAddr) (int, error) {
+	if addr == nil {
+		return c.UDPConn.WriteToUDP(payload, addr)
+	}
+	return c.WriteToUDPAddrPort(payload, addr.AddrPort())
+}
+
+// WriteToUDPAddrPort like net.UDPConn
+func (c *OutboundUDPConn) WriteToUDPAddrPort(payload []byte, addr netip.AddrPort) (int, error) {
+	if err := c.checkLoop(addr.Addr(), net.UDPAddrFromAddrPort(addr)); err != nil {
+		return 0, err
+	}
+	return c.UDPConn.WriteToUDPAddrPort(payload, addr)
+}
+
+// WriteMsgUDP like net.UDPConn
+func (c *OutboundUDPConn) WriteMsgUDP(payload, oob []byte, addr *net.UDPAddr) (n, oobn int, err error) {
+	if addr == nil {
+		return c.UDPConn.WriteMsgUDP(payload, oob, addr)
+	}
+	return c.WriteMsgUDPAddrPort(payload, oob, addr.AddrPort())
+}
+
+// WriteMsgUDPAddrPort like net.UDPConn
+func (c *OutboundUDPConn) WriteMsgUDPAddrPort(payload, oob []byte, addr netip.AddrPort) (n, oobn int, err error) {
+	if err := c.checkLoop(addr.Addr(), net.UDPAddrFromAddrPort(addr)); err != nil {
+		return 0, 0, err
+	}
+	return c.UDPConn.WriteMsgUDPAddrPort(payload, oob, addr)
+}
+
+// OutboundDialer the OutboundDialer for the proxy behind t, it refuses the
+// prefixes of the tun device and the destinations routed to it, and carries
+// AutoRouteMark when AutoRoute is set. It is shared with the passthrough
+// flows and must not be modified
+func (t *Tunat) OutboundDialer() *OutboundDialer {
+	return t.outbound
+}
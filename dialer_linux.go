@@ -0,0 +1,79 @@
+package tunat
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// control set SO_MARK and SO_BINDTODEVICE
+func (d *OutboundDialer) control(c syscall.RawConn) (err error) {
+	controlErr := c.Control(func(fd uintptr) {
+		if d.Mark != 0 {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(d.Mark))
+			if err != nil {
+				err = os.NewSyscallError("setsockopt", err)
+				return
+			}
+		}
+		if d.Interface != "" {
+			err = unix.BindToDevice(int(fd), d.Interface)
+			if err != nil {
+				err = os.NewSyscallError("setsockopt", err)
+			}
+		}
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return
+}
+
+// routeConn the netlink socket of the route lookups of every OutboundDialer
+var routeConn struct {
+	mutex sync.Mutex
+	conn  *netlinkConn
+}
+
+// routedToLoopDevice ask the kernel where a socket with Mark, bound to
+// Interface, sends packets to addr. d.mutex is held
+func (d *OutboundDialer) routedToLoopDevice(addr netip.Addr) (loop bool, err error) {
+	if d.loopIndex == 0 {
+		iface, err := net.InterfaceByName(d.LoopDevice)
+		if err != nil {
+			return false, err
+		}
+		d.loopIndex = iface.Index
+	}
+	if d.Interface != "" && d.bindIndex == 0 {
+		iface, err := net.InterfaceByName(d.Interface)
+		if err != nil {
+			return false, err
+		}
+		d.bindIndex = iface.Index
+	}
+
+	routeConn.mutex.Lock()
+	defer routeConn.mutex.Unlock()
+	if routeConn.conn == nil {
+		routeConn.conn, err = dialNetlink()
+		if err != nil {
+			return false, fmt.Errorf("tunat route lookup: %w", err)
+		}
+	}
+	index, err := routeConn.conn.routeGet(addr, d.Mark, d.bindIndex)
+	if err != nil {
+		// the kernel has no route, otherwise the socket is broken
+		if _, ok := err.(syscall.Errno); !ok {
+			routeConn.conn.Close()
+			routeConn.conn = nil
+		}
+		return false, fmt.Errorf("tunat route lookup %v: %w", addr, err)
+	}
+	return index == d.loopIndex, nil
+}
@@ -0,0 +1,96 @@
+package tunat
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestOutboundDialerLoopPrefixes(t *testing.T) {
+	dialer := &OutboundDialer{LoopPrefixes: []netip.Prefix{netip.MustParsePrefix("127.0.0.2/32")}}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	_, err = dialer.Dial("tcp", "127.0.0.2:80")
+	if !errors.Is(err, ErrLoop) {
+		t.Fatalf("dial a loop prefix: %v", err)
+	}
+
+	packetConn, err := dialer.ListenPacket(context.Background(), "udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packetConn.Close()
+	_, err = packetConn.WriteTo([]byte("abcd"), packetConn.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	loopAddr := netip.MustParseAddrPort("127.0.0.2:80")
+	udpConn := packetConn.(*OutboundUDPConn)
+	for name, write := range map[string]func() error{
+		"WriteTo": func() error {
+			_, err := udpConn.WriteTo([]byte("abcd"), net.UDPAddrFromAddrPort(loopAddr))
+			return err
+		},
+		"WriteTo other net.Addr": func() error {
+			_, err := udpConn.WriteTo([]byte("abcd"), stringAddr(loopAddr.String()))
+			return err
+		},
+		"WriteToUDP": func() error {
+			_, err := udpConn.WriteToUDP([]byte("abcd"), net.UDPAddrFromAddrPort(loopAddr))
+			return err
+		},
+		"WriteToUDPAddrPort": func() error {
+			_, err := udpConn.WriteToUDPAddrPort([]byte("abcd"), loopAddr)
+			return err
+		},
+		"WriteMsgUDP": func() error {
+			_, _, err := udpConn.WriteMsgUDP([]byte("abcd"), nil, net.UDPAddrFromAddrPort(loopAddr))
+			return err
+		},
+		"WriteMsgUDPAddrPort": func() error {
+			_, _, err := udpConn.WriteMsgUDPAddrPort([]byte("abcd"), nil, loopAddr)
+			return err
+		},
+	} {
+		if err := write(); !errors.Is(err, ErrLoop) {
+			t.Fatalf("%s to a loop prefix: %v", name, err)
+		}
+	}
+	_, err = udpConn.WriteTo([]byte("abcd"), stringAddr("localhost"))
+	if err == nil {
+		t.Fatal("write to an address that is not an ip:port")
+	}
+	_, err = dialer.ListenPacket(context.Background(), "ip4:icmp", "127.0.0.1")
+	if err == nil {
+		t.Fatal("listen a network that is not udp")
+	}
+}
+
+// stringAddr a net.Addr that is not a *net.UDPAddr
+type stringAddr string
+
+func (a stringAddr) Network() string { return "udp" }
+
+func (a stringAddr) String() string { return string(a) }
+
+func TestOutboundDialerTunat(t *testing.T) {
+	tn, _ := newTestTunat(t)
+	dialer := tn.OutboundDialer()
+	for _, address := range []string{"10.0.0.3:80", "[fd::3]:80", "[::ffff:10.0.0.3]:80"} {
+		_, err := dialer.Dial("udp", address)
+		if !errors.Is(err, ErrLoop) {
+			t.Fatalf("dial %v: %v", address, err)
+		}
+	}
+}
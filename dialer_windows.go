@@ -0,0 +1,50 @@
+package tunat
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"syscall"
+)
+
+// IP_UNICAST_IF and IPV6_UNICAST_IF of ws2ipdef.h
+const (
+	ipUnicastIf   = 31
+	ipv6UnicastIf = 31
+)
+
+// control bind to Interface with IP_UNICAST_IF, marks are not supported
+func (d *OutboundDialer) control(c syscall.RawConn) (err error) {
+	if d.Mark != 0 {
+		return errors.New("tunat: Mark not supported on windows")
+	}
+	if d.Interface == "" {
+		return nil
+	}
+	iface, err := net.InterfaceByName(d.Interface)
+	if err != nil {
+		return
+	}
+	controlErr := c.Control(func(fd uintptr) {
+		// IP_UNICAST_IF takes the index in network byte order
+		var index [4]byte
+		binary.BigEndian.PutUint32(index[:], uint32(iface.Index))
+		err4 := syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, ipUnicastIf, int(binary.LittleEndian.Uint32(index[:])))
+		// dual stack sockets need both, ipv4 or ipv6 only sockets one of them
+		err6 := syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, ipv6UnicastIf, iface.Index)
+		if err4 != nil && err6 != nil {
+			err = os.NewSyscallError("setsockopt", err4)
+		}
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return
+}
+
+// routedToLoopDevice only LoopPrefixes are checked on windows
+func (d *OutboundDialer) routedToLoopDevice(addr netip.Addr) (loop bool, err error) {
+	return false, nil
+}
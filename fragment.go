@@ -0,0 +1,106 @@
+package tunat
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// ErrPayloadTooLarge returned when a UDP payload does not fit in an ip
+// packet even with fragmentation
+var ErrPayloadTooLarge = errors.New("tunat: udp payload too large")
+
+const (
+	maxIPv4UDPPayload = 0xffff - header.IPv4MinimumSize - header.UDPMinimumSize
+	maxIPv6UDPPayload = 0xffff - header.UDPMinimumSize
+)
+
+// writeIPv4 fragment packet if it is larger than the MTU
+func (t *Tunat) writeIPv4(packet header.IPv4) error {
+	if len(packet) <= t.bufLen {
+		_, err := t.file.Write(packet)
+		return err
+	}
+
+	id := uint16(atomic.AddUint32(&t.fragmentID, 1))
+	payload := packet.Payload()
+	fragmentSize := (t.bufLen - header.IPv4MinimumSize) &^ 7
+	buf := t.buffers.get(t.bufLen)
+	defer t.buffers.put(buf)
+
+	for offset := 0; offset < len(payload); offset += fragmentSize {
+		end := offset + fragmentSize
+		var flags uint8
+		if end < len(payload) {
+			flags = header.IPv4FlagMoreFragments
+		} else {
+			end = len(payload)
+		}
+
+		fragment := header.IPv4((*buf)[:header.IPv4MinimumSize+end-offset])
+		fragment.Encode(&header.IPv4Fields{
+			TotalLength:    uint16(len(fragment)),
+			ID:             id,
+			Flags:          flags,
+			FragmentOffset: uint16(offset),
+			TTL:            packet.TTL(),
+			Protocol:       packet.Protocol(),
+			SrcAddr:        packet.SourceAddress(),
+			DstAddr:        packet.DestinationAddress(),
+		})
+		fragment.SetChecksum(^fragment.CalculateChecksum())
+		copy(fragment[header.IPv4MinimumSize:], payload[offset:end])
+
+		if _, err := t.file.Write(fragment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeIPv6 fragment packet with a Fragment header if it is larger than the
+// MTU, packet has no extension header
+func (t *Tunat) writeIPv6(packet header.IPv6) error {
+	if len(packet) <= t.bufLen {
+		_, err := t.file.Write(packet)
+		return err
+	}
+
+	id := atomic.AddUint32(&t.fragmentID, 1)
+	payload := packet.Payload()
+	fragmentSize := (t.bufLen - header.IPv6MinimumSize - header.IPv6FragmentHeaderSize) &^ 7
+	buf := t.buffers.get(t.bufLen)
+	defer t.buffers.put(buf)
+
+	for offset := 0; offset < len(payload); offset += fragmentSize {
+		end := offset + fragmentSize
+		var more uint16
+		if end < len(payload) {
+			more = 1
+		} else {
+			end = len(payload)
+		}
+
+		fragment := header.IPv6((*buf)[:header.IPv6MinimumSize+header.IPv6FragmentHeaderSize+end-offset])
+		fragment.Encode(&header.IPv6Fields{
+			PayloadLength:     uint16(header.IPv6FragmentHeaderSize + end - offset),
+			TransportProtocol: header.IPv6FragmentHeader,
+			HopLimit:          packet.HopLimit(),
+			SrcAddr:           packet.SourceAddress(),
+			DstAddr:           packet.DestinationAddress(),
+		})
+		fragmentHeader := fragment[header.IPv6MinimumSize:]
+		fragmentHeader[0] = uint8(packet.TransportProtocol())
+		fragmentHeader[1] = 0
+		binary.BigEndian.PutUint16(fragmentHeader[2:], uint16(offset)|more)
+		binary.BigEndian.PutUint32(fragmentHeader[4:], id)
+		copy(fragmentHeader[header.IPv6FragmentHeaderSize:], payload[offset:end])
+
+		if _, err := t.file.Write(fragment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package tunat
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+func TestFragment(t *testing.T) {
+	tn, dev := newTunatWithOptions(t, WithMTU(1280))
+	payload := make([]byte, 3000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		saddr netip.AddrPort
+		daddr netip.AddrPort
+	}{
+		{"ipv4", netip.MustParseAddrPort("1.2.3.4:443"), netip.MustParseAddrPort("10.0.0.1:1234")},
+		{"ipv6", netip.MustParseAddrPort("[2001:db8::1]:443"), netip.MustParseAddrPort("[fd::1]:1234")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			nwrite, err := tn.WriteToUDPAddrPort(payload, tt.saddr, tt.daddr)
+			if err != nil || nwrite != len(payload) {
+				t.Fatalf("wrote %d %v", nwrite, err)
+			}
+
+			var datagram []byte
+			var id uint32
+			for more := true; more; {
+				packet := readPacket(t, dev)
+				if len(packet) > 1280 {
+					t.Fatalf("fragment of %d bytes", len(packet))
+				}
+				var offset int
+				var fragmentPayload []byte
+				if tt.saddr.Addr().Is4() {
+					ipHeader := header.IPv4(packet)
+					if !ipHeader.IsChecksumValid() {
+						t.Fatal("bad ipv4 checksum")
+					}
+					if datagram == nil {
+						id = uint32(ipHeader.ID())
+					}
+					if uint32(ipHeader.ID()) != id {
+						t.Fatal("fragments with different ids")
+					}
+					offset, more, fragmentPayload = int(ipHeader.FragmentOffset()), ipHeader.More(), ipHeader.Payload()
+				} else {
+					ipHeader := header.IPv6(packet)
+					if ipHeader.NextHeader() != header.IPv6FragmentHeader {
+						t.Fatal("no fragment header")
+					}
+					fragmentHeader := header.IPv6Fragment(ipHeader.Payload())
+					if datagram == nil {
+						id = fragmentHeader.ID()
+					}
+					if fragmentHeader.ID() != id || fragmentHeader.TransportProtocol() != header.UDPProtocolNumber {
+						t.Fatal("bad fragment header")
+					}
+					offset, more, fragmentPayload = int(fragmentHeader.FragmentOffset())*8, fragmentHeader.More(), fragmentHeader.Payload()
+				}
+				if offset != len(datagram) {
+					t.Fatalf("fragment at %d, want %d", offset, len(datagram))
+				}
+				if more && len(fragmentPayload)%8 != 0 {
+					t.Fatalf("fragment of %d bytes", len(fragmentPayload))
+				}
+				datagram = append(datagram, fragmentPayload...)
+			}
+
+			udpHeader := header.UDP(datagram)
+			if int(udpHeader.Length()) != len(datagram) || !bytes.Equal(udpHeader.Payload(), payload) {
+				t.Fatal("bad datagram")
+			}
+		})
+	}
+}
+
+func TestPayloadTooLarge(t *testing.T) {
+	tn, _ := newTestTunat(t)
+
+	for _, tt := range []struct {
+		saddr netip.AddrPort
+		daddr netip.AddrPort
+		size  int
+	}{
+		{netip.MustParseAddrPort("1.2.3.4:443"), netip.MustParseAddrPort("10.0.0.1:1234"), 65508},
+		{netip.MustParseAddrPort("[2001:db8::1]:443"), netip.MustParseAddrPort("[fd::1]:1234"), 65528},
+	} {
+		if _, err := tn.WriteToUDPAddrPort(make([]byte, tt.size), tt.saddr, tt.daddr); !errors.Is(err, ErrPayloadTooLarge) {
+			t.Fatalf("want ErrPayloadTooLarge, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+//go:build go1.18
+
+package tunat
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/FH0/tunat/device"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// fuzzHandlePacket no packet read from the device may panic
+func fuzzHandlePacket(f *testing.F, seeds ...[]byte) {
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	tn, dev := newTunatWithOptions(f)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			if _, err := dev.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		tn.handlePacket(packet, nil)
+	})
+}
+
+func FuzzIPv4TCP(f *testing.F) {
+	saddr := netip.MustParseAddrPort("10.0.0.1:1234")
+	daddr := netip.MustParseAddrPort("1.2.3.4:80")
+	fuzzHandlePacket(f,
+		buildTCP(saddr, daddr, header.TCPFlagSyn, nil),
+		buildTCP(saddr, daddr, header.TCPFlagAck, []byte("abcd")),
+	)
+}
+
+func FuzzIPv4UDP(f *testing.F) {
+	saddr := netip.MustParseAddrPort("10.0.0.1:1234")
+	daddr := netip.MustParseAddrPort("1.2.3.4:53")
+	fuzzHandlePacket(f, append([][]byte{buildUDP(saddr, daddr, []byte("abcd"))},
+		buildFragments(saddr, daddr, make([]byte, 100), 68)...)...)
+}
+
+func FuzzIPv6TCP(f *testing.F) {
+	saddr := netip.MustParseAddrPort("[fd::1]:1234")
+	daddr := netip.MustParseAddrPort("[2001:db8::1]:80")
+	fuzzHandlePacket(f,
+		buildTCP(saddr, daddr, header.TCPFlagSyn, nil),
+		withExtensionHeaders(buildTCP(saddr, daddr, header.TCPFlagAck, []byte("abcd"))),
+	)
+}
+
+func FuzzIPv6UDP(f *testing.F) {
+	saddr := netip.MustParseAddrPort("[fd::1]:1234")
+	daddr := netip.MustParseAddrPort("[2001:db8::1]:53")
+	fuzzHandlePacket(f, append([][]byte{withExtensionHeaders(buildUDP(saddr, daddr, []byte("abcd")))},
+		buildFragments(saddr, daddr, make([]byte, 100), 88)...)...)
+}
+
+// FuzzOffload the virtio_net_hdr is the first VirtioNetHdrLen bytes, its
+// CsumStart and GSOSize drive the parsing of super-packets
+func FuzzOffload(f *testing.F) {
+	seed := func(hdr device.VirtioNetHdr, packet []byte) {
+		b := make([]byte, device.VirtioNetHdrLen)
+		hdr.Encode(b)
+		f.Add(append(b, packet...))
+	}
+	hdr, packet := partialTCP(netip.MustParseAddrPort("10.0.0.1:1234"), netip.MustParseAddrPort("1.2.3.4:80"),
+		header.TCPFlagAck, make([]byte, 3000))
+	hdr.GSOType, hdr.GSOSize = device.GSOTCPv4, 1400
+	seed(hdr, packet)
+	seed(device.VirtioNetHdr{
+		Flags:      device.VirtioNetHdrFNeedsCsum,
+		GSOType:    device.GSOUDPL4,
+		HdrLen:     header.IPv6MinimumSize + header.UDPMinimumSize,
+		GSOSize:    100,
+		CsumStart:  header.IPv6MinimumSize,
+		CsumOffset: 6,
+	}, buildUDP(netip.MustParseAddrPort("[fd::1]:1234"), netip.MustParseAddrPort("[2001:db8::1]:53"), make([]byte, 250)))
+
+	dev := newOffloadPipe()
+	tn, _ := newTunatWithOptions(f, WithDevice(dev))
+	go func() {
+		for {
+			select {
+			case <-dev.tx:
+			case <-dev.closed:
+				return
+			}
+		}
+	}()
+
+	segment := make([]byte, maxOffloadPacket)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		if len(b) < device.VirtioNetHdrLen {
+			return
+		}
+		var hdr device.VirtioNetHdr
+		hdr.Decode(b)
+		tn.handleOffload(hdr, b[device.VirtioNetHdrLen:], segment)
+	})
+}
@@ -0,0 +1,428 @@
+package tunat
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+const natShardCount = 64
+
+// natLRUGranularity an entry moves to the front of the lru list at most once
+// per natLRUGranularity, relinking on every packet costs more than the lookup
+const natLRUGranularity = time.Second
+
+// natEvictScan entries checked from the lru end of a shard for one to
+// evict, gc removes the idle entries that are not found
+const natEvictScan = 8
+
+// DefaultMaxTCPEntries default capacity of each tcp nat table
+const DefaultMaxTCPEntries = 1 << 18
+
+// natPoolMaxAddrs cap the number of fake addresses, 2^32 addresses times
+// 65535 ports are more than enough and still fit in a slot
+const natPoolMaxAddrs = 1 << 32
+
+// natPool fake source addresses, a slot is one fake address and port
+type natPool struct {
+	first   netip.Addr
+	addrs   uint64
+	exclude netip.Addr // the listener address
+}
+
+// newNATPool use the whole prefix except the network address, the ipv4
+// broadcast address and exclude
+func newNATPool(prefix netip.Prefix, exclude netip.Addr) (pool natPool, ok bool) {
+	prefix = prefix.Masked()
+	pool.first = prefix.Addr()
+	pool.exclude = exclude
+	pool.addrs = natPoolMaxAddrs
+	if hostBits := pool.first.BitLen() - prefix.Bits(); hostBits < 32 {
+		pool.addrs = 1 << hostBits
+	}
+
+	if pool.addrs > 2 || (pool.first.Is6() && pool.addrs == 2) {
+		pool.first = pool.first.Next()
+		pool.addrs--
+	}
+	if pool.first.Is4() && pool.addrs > 2 {
+		pool.addrs--
+	}
+	if pool.addrs == 1 && pool.first == exclude {
+		return pool, false
+	}
+	return pool, true
+}
+
+func (p *natPool) slots() uint64 {
+	return p.addrs * 65535
+}
+
+func (p *natPool) addrPort(slot uint64) (netip.AddrPort, bool) {
+	addr := addrAdd(p.first, slot/65535)
+	if addr == p.exclude {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(addr, uint16(slot%65535+1)), true
+}
+
+func (p *natPool) slot(addrPort netip.AddrPort) (uint64, bool) {
+	offset, ok := addrSub(addrPort.Addr(), p.first)
+	if !ok || offset >= p.addrs || addrPort.Port() == 0 || addrPort.Addr() == p.exclude {
+		return 0, false
+	}
+	return offset*65535 + uint64(addrPort.Port()-1), true
+}
+
+func addrAdd(addr netip.Addr, n uint64) netip.Addr {
+	b := addr.As16()
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	if lo+n < lo {
+		hi++
+	}
+	binary.BigEndian.PutUint64(b[:8], hi)
+	binary.BigEndian.PutUint64(b[8:], lo+n)
+	if addr.Is4() {
+		return netip.AddrFrom16(b).Unmap()
+	}
+	return netip.AddrFrom16(b)
+}
+
+// addrSub a - b, ok if the result fits in uint64
+func addrSub(a, b netip.Addr) (uint64, bool) {
+	if a.Is4() != b.Is4() {
+		return 0, false
+	}
+	aBytes, bBytes := a.As16(), b.As16()
+	aHi, aLo := binary.BigEndian.Uint64(aBytes[:8]), binary.BigEndian.Uint64(aBytes[8:])
+	bHi, bLo := binary.BigEndian.Uint64(bBytes[:8]), binary.BigEndian.Uint64(bBytes[8:])
+	switch {
+	case aHi == bHi && aLo >= bLo:
+		return aLo - bLo, true
+	case aHi == bHi+1 && aLo < bLo:
+		return aLo - bLo, true
+	}
+	return 0, false
+}
+
+type natEntry struct {
+	saddr       netip.AddrPort // original source
+	daddr       netip.AddrPort // original destination
+	fakeAddr    netip.AddrPort
+	slot        uint64
+	track       conntrack
+	passthrough bool // relayed to daddr instead of returned by Accept
+
+	// lru list of the shard, the most recently used is lru.next
+	prev    *natEntry
+	next    *natEntry
+	touched time.Time
+}
+
+// natShard an entry lives in the shard of its saddr, and only gets a slot
+// owned by that shard, so one lock covers both maps
+type natShard struct {
+	mutex    sync.Mutex
+	bySource map[netip.AddrPort]*natEntry
+	bySlot   map[uint64]*natEntry
+	lru      natEntry
+	nextSlot uint64   // the smallest never used slot of this shard
+	free     []uint64 // released slots, reused first in first out
+}
+
+// natTable tcp nat map of one ip family
+type natTable struct {
+	count      int64 // entries of all shards, first for 64-bit alignment
+	maxEntries int64
+	pool       natPool
+	shards     [natShardCount]natShard
+}
+
+func newNATTable(pool natPool, maxEntries int) *natTable {
+	n := &natTable{
+		pool:       pool,
+		maxEntries: int64(maxEntries),
+	}
+	for i := range n.shards {
+		n.shards[i].reset(uint64(i))
+	}
+	return n
+}
+
+func (s *natShard) reset(index uint64) {
+	s.bySource = make(map[netip.AddrPort]*natEntry)
+	s.bySlot = make(map[uint64]*natEntry)
+	s.lru.prev = &s.lru
+	s.lru.next = &s.lru
+	s.nextSlot = index
+	s.free = nil
+}
+
+func (s *natShard) touch(entry *natEntry, now time.Time) {
+	if now.Sub(entry.touched) < natLRUGranularity {
+		return
+	}
+	entry.touched = now
+	entry.prev.next = entry.next
+	entry.next.prev = entry.prev
+	entry.prev = &s.lru
+	entry.next = s.lru.next
+	s.lru.next.prev = entry
+	s.lru.next = entry
+}
+
+// retire move a finished entry to the lru end, it is evicted first
+func (s *natShard) retire(entry *natEntry) {
+	entry.prev.next = entry.next
+	entry.next.prev = entry.prev
+	entry.prev = s.lru.prev
+	entry.next = &s.lru
+	s.lru.prev.next = entry
+	s.lru.prev = entry
+}
+
+func (s *natShard) remove(entry *natEntry) {
+	entry.prev.next = entry.next
+	entry.next.prev = entry.prev
+	delete(s.bySource, entry.saddr)
+	delete(s.bySlot, entry.slot)
+	s.free = append(s.free, entry.slot)
+}
+
+// evictable an entry near the lru end that is finished or idle beyond its
+// timeout, nil if there is none
+func (s *natShard) evictable(now time.Time, timeouts *TCPTimeouts) *natEntry {
+	entry := s.lru.prev
+	for i := 0; i < natEvictScan && entry != &s.lru; i++ {
+		if entry.track.reusable() || entry.track.expired(now, timeouts) {
+			return entry
+		}
+		entry = entry.prev
+	}
+	return nil
+}
+
+// update follow the flags of a packet of entry
+func (s *natShard) update(entry *natEntry, flags header.TCPFlags, fromClient bool, now time.Time) {
+	entry.track.update(flags, fromClient, now)
+	if entry.track.reusable() {
+		s.retire(entry)
+	} else {
+		s.touch(entry, now)
+	}
+}
+
+func (n *natTable) remove(shard *natShard, entry *natEntry) {
+	shard.remove(entry)
+	atomic.AddInt64(&n.count, -1)
+}
+
+func hashAddrPort(addrPort netip.AddrPort) uint32 {
+	b := addrPort.Addr().As16()
+	h := uint32(addrPort.Port()) * 0x9e3779b1
+	for i := 0; i < 16; i += 4 {
+		h = (h ^ binary.BigEndian.Uint32(b[i:])) * 0x85ebca6b
+	}
+	return h ^ h>>16
+}
+
+func (n *natTable) sourceShard(saddr netip.AddrPort) *natShard {
+	return &n.shards[hashAddrPort(saddr)%natShardCount]
+}
+
+// reserve count one more entry, evicting a finished or idle entry of any
+// shard when the table is full. The caller must not hold a shard lock
+func (n *natTable) reserve(saddr netip.AddrPort, now time.Time, timeouts *TCPTimeouts) bool {
+	for atomic.AddInt64(&n.count, 1) > n.maxEntries {
+		atomic.AddInt64(&n.count, -1)
+		if !n.evict(hashAddrPort(saddr)%natShardCount, now, timeouts) {
+			return false
+		}
+	}
+	return true
+}
+
+// evict one finished or idle entry, starting from shard first
+func (n *natTable) evict(first uint32, now time.Time, timeouts *TCPTimeouts) bool {
+	for i := uint32(0); i < natShardCount; i++ {
+		shard := &n.shards[(first+i)%natShardCount]
+		shard.mutex.Lock()
+		entry := shard.evictable(now, timeouts)
+		if entry != nil {
+			n.remove(shard, entry)
+		}
+		shard.mutex.Unlock()
+		if entry != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupSource a packet from the original source, returns the fake source
+// address. A new SYN does not match an entry that is finished
+func (n *natTable) lookupSource(saddr netip.AddrPort, flags header.TCPFlags, now time.Time) (fakeAddr netip.AddrPort, ok bool) {
+	shard := n.sourceShard(saddr)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	entry, ok := shard.bySource[saddr]
+	if !ok {
+		return
+	}
+	if isNewSyn(flags) && entry.track.reusable() {
+		n.remove(shard, entry)
+		return fakeAddr, false
+	}
+	shard.update(entry, flags, true, now)
+	return entry.fakeAddr, true
+}
+
+// lookupFake a packet from the listener to a fake address, returns the
+// original source and destination
+func (n *natTable) lookupFake(fakeAddr netip.AddrPort, flags header.TCPFlags, now time.Time) (saddr, daddr netip.AddrPort, ok bool) {
+	slot, ok := n.pool.slot(fakeAddr)
+	if !ok {
+		return
+	}
+	shard := &n.shards[slot%natShardCount]
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	entry, ok := shard.bySlot[slot]
+	if !ok {
+		return
+	}
+	shard.update(entry, flags, false, now)
+	return entry.saddr, entry.daddr, true
+}
+
+// get like lookupFake without touching the entry
+func (n *natTable) get(fakeAddr netip.AddrPort) (saddr, daddr netip.AddrPort, passthrough, ok bool) {
+	slot, ok := n.pool.slot(fakeAddr)
+	if !ok {
+		return
+	}
+	shard := &n.shards[slot%natShardCount]
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	entry, ok := shard.bySlot[slot]
+	if !ok {
+		return
+	}
+	return entry.saddr, entry.daddr, entry.passthrough, true
+}
+
+// insert allocate a fake address for a new connection. Beyond maxEntries or
+// once the slots of the shard are used up a finished or idle entry is
+// evicted, live connections are never evicted and insert fails instead
+func (n *natTable) insert(saddr, daddr netip.AddrPort, passthrough bool, now time.Time, timeouts *TCPTimeouts) (fakeAddr netip.AddrPort, ok bool) {
+	if !n.reserve(saddr, now, timeouts) {
+		return
+	}
+	shard := n.sourceShard(saddr)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if entry, ok := shard.bySource[saddr]; ok {
+		// another queue inserted the same SYN since lookupSource
+		if entry.daddr == daddr && !entry.track.reusable() {
+			atomic.AddInt64(&n.count, -1)
+			return entry.fakeAddr, true
+		}
+		n.remove(shard, entry)
+	}
+
+	slot, fakeAddr, ok := n.allocate(shard)
+	if !ok {
+		// the slots of the shard are used up
+		if entry := shard.evictable(now, timeouts); entry != nil {
+			n.remove(shard, entry)
+			slot, fakeAddr, ok = n.allocate(shard)
+		}
+		if !ok {
+			atomic.AddInt64(&n.count, -1)
+			return
+		}
+	}
+
+	entry := &natEntry{
+		saddr:       saddr,
+		daddr:       daddr,
+		fakeAddr:    fakeAddr,
+		slot:        slot,
+		track:       newConntrack(now),
+		touched:     now,
+		passthrough: passthrough,
+	}
+	entry.prev = &shard.lru
+	entry.next = shard.lru.next
+	shard.lru.next.prev = entry
+	shard.lru.next = entry
+	shard.bySource[saddr] = entry
+	shard.bySlot[slot] = entry
+	return fakeAddr, true
+}
+
+func (n *natTable) allocate(shard *natShard) (slot uint64, fakeAddr netip.AddrPort, ok bool) {
+	for len(shard.free) != 0 {
+		slot = shard.free[0]
+		shard.free = shard.free[1:]
+		if fakeAddr, ok = n.pool.addrPort(slot); ok {
+			return
+		}
+	}
+	for shard.nextSlot < n.pool.slots() {
+		slot = shard.nextSlot
+		shard.nextSlot += natShardCount
+		if fakeAddr, ok = n.pool.addrPort(slot); ok {
+			return
+		}
+	}
+	return
+}
+
+// gc remove expired entries
+func (n *natTable) gc(now time.Time, timeouts *TCPTimeouts) {
+	for i := range n.shards {
+		shard := &n.shards[i]
+		shard.mutex.Lock()
+		for _, entry := range shard.bySource {
+			if entry.track.expired(now, timeouts) {
+				n.remove(shard, entry)
+			}
+		}
+		shard.mutex.Unlock()
+	}
+}
+
+// reset remove all entries
+func (n *natTable) reset() {
+	for i := range n.shards {
+		shard := &n.shards[i]
+		shard.mutex.Lock()
+		atomic.AddInt64(&n.count, -int64(len(shard.bySource)))
+		shard.reset(uint64(i))
+		shard.mutex.Unlock()
+	}
+}
+
+func (n *natTable) len() (count int) {
+	for i := range n.shards {
+		shard := &n.shards[i]
+		shard.mutex.Lock()
+		count += len(shard.bySource)
+		shard.mutex.Unlock()
+	}
+	return
+}
+
+func isNewSyn(flags header.TCPFlags) bool {
+	return flags&header.TCPFlagSyn != 0 && flags&header.TCPFlagAck == 0
+}
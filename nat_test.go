@@ -0,0 +1,289 @@
+package tunat
+
+import (
+	"net/netip"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// testNATPool 10.0.0.2 only
+var testNATPool, _ = newNATPool(netip.MustParsePrefix("10.0.0.2/32"), netip.Addr{})
+
+func TestNATPool(t *testing.T) {
+	for _, tt := range []struct {
+		prefix  string
+		exclude string
+		first   string
+		addrs   uint64
+	}{
+		{"10.0.0.1/24", "10.0.0.1", "10.0.0.1", 254},
+		{"10.0.0.0/31", "10.0.0.0", "10.0.0.0", 2},
+		{"10.0.0.1/32", "", "10.0.0.1", 1},
+		{"fd::1/120", "fd::1", "fd::1", 255},
+		{"fd::/64", "fd::1", "fd::1", natPoolMaxAddrs - 1},
+	} {
+		exclude, _ := netip.ParseAddr(tt.exclude)
+		pool, ok := newNATPool(netip.MustParsePrefix(tt.prefix), exclude)
+		if !ok || pool.first.String() != tt.first || pool.addrs != tt.addrs {
+			t.Fatalf("%v: %v %v %v", tt.prefix, pool.first, pool.addrs, ok)
+		}
+
+		for _, slot := range []uint64{0, 65534, 65535, pool.slots() - 1} {
+			if slot >= pool.slots() {
+				continue
+			}
+			addrPort, ok := pool.addrPort(slot)
+			if addrAdd(pool.first, slot/65535) == exclude {
+				if ok {
+					t.Fatalf("%v: excluded address allocated", tt.prefix)
+				}
+				continue
+			}
+			if !ok || !netip.MustParsePrefix(tt.prefix).Contains(addrPort.Addr()) || addrPort.Port() == 0 {
+				t.Fatalf("%v: slot %v is %v", tt.prefix, slot, addrPort)
+			}
+			if got, ok := pool.slot(addrPort); !ok || got != slot {
+				t.Fatalf("%v: %v is slot %v, want %v", tt.prefix, addrPort, got, slot)
+			}
+		}
+	}
+
+	if _, ok := newNATPool(netip.MustParsePrefix("10.0.0.1/32"), netip.MustParseAddr("10.0.0.1")); ok {
+		t.Fatal("pool without address")
+	}
+}
+
+func TestNATTable(t *testing.T) {
+	table := newNATTable(testNATPool, DefaultMaxTCPEntries)
+	now := time.Now()
+	saddr := netip.MustParseAddrPort("10.0.0.1:1234")
+	daddr := netip.MustParseAddrPort("1.2.3.4:80")
+
+	fakeAddr, ok := table.insert(saddr, daddr, false, now, &DefaultTCPTimeouts)
+	if !ok {
+		t.Fatal("insert failed")
+	}
+	if got, ok := table.lookupSource(saddr, header.TCPFlagAck, now); !ok || got != fakeAddr {
+		t.Fatalf("lookupSource %v %v", got, ok)
+	}
+	if gotSaddr, gotDaddr, ok := table.lookupFake(fakeAddr, header.TCPFlagAck, now); !ok || gotSaddr != saddr || gotDaddr != daddr {
+		t.Fatalf("lookupFake %v %v %v", gotSaddr, gotDaddr, ok)
+	}
+	if _, _, ok := table.lookupFake(netip.MustParseAddrPort("10.0.0.3:1"), header.TCPFlagAck, now); ok {
+		t.Fatal("lookupFake outside of pool")
+	}
+
+	table.reset()
+	if table.len() != 0 {
+		t.Fatal("reset failed")
+	}
+}
+
+func TestNATTableEvict(t *testing.T) {
+	// fewer entries than shards
+	table := newNATTable(testNATPool, 3)
+	now := time.Now()
+	daddr := netip.MustParseAddrPort("1.2.3.4:80")
+	saddr := func(port uint16) netip.AddrPort {
+		return netip.AddrPortFrom(netip.MustParseAddr("10.0.0.1"), port)
+	}
+
+	for port := uint16(1); port <= 3; port++ {
+		if _, ok := table.insert(saddr(port), daddr, false, now, &DefaultTCPTimeouts); !ok {
+			t.Fatal("insert failed")
+		}
+	}
+	if _, ok := table.insert(saddr(4), daddr, false, now, &DefaultTCPTimeouts); ok || table.len() != 3 {
+		t.Fatalf("live connection evicted, %v entries", table.len())
+	}
+
+	// a finished connection is evicted
+	table.lookupSource(saddr(1), header.TCPFlagRst, now)
+	if _, ok := table.insert(saddr(4), daddr, false, now, &DefaultTCPTimeouts); !ok {
+		t.Fatal("insert failed")
+	}
+	if _, ok := table.lookupSource(saddr(1), header.TCPFlagAck, now); ok || table.len() != 3 {
+		t.Fatalf("finished connection kept, %v entries", table.len())
+	}
+
+	// so is an idle one
+	later := now.Add(DefaultTCPTimeouts.SynSent + time.Second)
+	if _, ok := table.insert(saddr(5), daddr, false, later, &DefaultTCPTimeouts); !ok || table.len() != 3 {
+		t.Fatalf("idle connection kept, %v entries", table.len())
+	}
+}
+
+func TestNATTableInsertTwice(t *testing.T) {
+	table := newNATTable(testNATPool, DefaultMaxTCPEntries)
+	now := time.Now()
+	saddr := netip.MustParseAddrPort("10.0.0.1:1234")
+	daddr := netip.MustParseAddrPort("1.2.3.4:80")
+
+	// the same SYN read from two queues
+	first, _ := table.insert(saddr, daddr, false, now, &DefaultTCPTimeouts)
+	second, _ := table.insert(saddr, daddr, false, now, &DefaultTCPTimeouts)
+	if first != second || table.len() != 1 {
+		t.Fatalf("%v and %v, %v entries", first, second, table.len())
+	}
+}
+
+func TestNATTableExhausted(t *testing.T) {
+	table := newNATTable(testNATPool, 1<<20)
+	now := time.Now()
+	daddr := netip.MustParseAddrPort("1.2.3.4:80")
+
+	// every shard owns about 65535/natShardCount slots, live connections keep
+	// them once they are used up
+	saddr := func(i int) netip.AddrPort {
+		return netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)}), 1234)
+	}
+	seen := make(map[netip.AddrPort]bool)
+	var failed int
+	for i := 0; i < 70000; i++ {
+		fakeAddr, ok := table.insert(saddr(i), daddr, false, now, &DefaultTCPTimeouts)
+		if !ok {
+			failed++
+			continue
+		}
+		if fakeAddr.Port() == 0 {
+			t.Fatal("port 0 allocated")
+		}
+		seen[fakeAddr] = true
+	}
+	if len(seen) != table.len() || table.len() > 65535 || table.len() < 60000 || failed != 70000-table.len() {
+		t.Fatalf("%v fake addresses, %v entries, %v failed", len(seen), table.len(), failed)
+	}
+
+	// idle ones give them up
+	later := now.Add(DefaultTCPTimeouts.SynSent + time.Second)
+	for i := 70000; i < 71000; i++ {
+		if _, ok := table.insert(saddr(i), daddr, false, later, &DefaultTCPTimeouts); !ok {
+			t.Fatal("insert failed")
+		}
+	}
+	for i := range table.shards {
+		if len(table.shards[i].bySource) != len(table.shards[i].bySlot) {
+			t.Fatal("fake address shared by two entries")
+		}
+	}
+}
+
+// syncMapNAT the sync.Map approach replaced by natTable, kept for benchmarks
+type syncMapNAT struct {
+	m      sync.Map
+	fakeIP netip.Addr
+}
+
+type syncMapNATValue struct {
+	natAddr netip.AddrPort
+	daddr   netip.AddrPort
+}
+
+func (n *syncMapNAT) handle(saddr, daddr netip.AddrPort, syn bool) (netip.AddrPort, bool) {
+	if syn {
+		if _, ok := n.m.Load(saddr); !ok {
+			for port, endPort := saddr.Port(), saddr.Port()-1; port != endPort; port++ {
+				if port == 0 {
+					continue
+				}
+				fakeAddr := netip.AddrPortFrom(n.fakeIP, port)
+				if _, ok := n.m.Load(fakeAddr); !ok {
+					n.m.Store(fakeAddr, &syncMapNATValue{natAddr: saddr, daddr: daddr})
+					n.m.Store(saddr, &syncMapNATValue{natAddr: fakeAddr, daddr: daddr})
+					break
+				}
+			}
+		}
+	}
+	if value, ok := n.m.Load(saddr); ok {
+		return value.(*syncMapNATValue).natAddr, true
+	} else if value, ok := n.m.Load(daddr); ok {
+		return value.(*syncMapNATValue).daddr, true
+	}
+	return netip.AddrPort{}, false
+}
+
+func benchmarkSources(count int) []netip.AddrPort {
+	saddrs := make([]netip.AddrPort, count)
+	for i := range saddrs {
+		saddrs[i] = netip.AddrPortFrom(netip.MustParseAddr("10.0.0.1"), uint16(1024+i))
+	}
+	return saddrs
+}
+
+// BenchmarkNATPacket every op is a data packet and its reply
+func BenchmarkNATPacket(b *testing.B) {
+	daddr := netip.MustParseAddrPort("1.2.3.4:80")
+	listenerAddr := netip.MustParseAddrPort("10.0.0.1:100")
+	for _, flows := range []int{100, 10000} {
+		saddrs := benchmarkSources(flows)
+		fakeAddrs := make([]netip.AddrPort, flows)
+
+		b.Run("syncMap/"+strconv.Itoa(flows), func(b *testing.B) {
+			n := &syncMapNAT{fakeIP: netip.MustParseAddr("10.0.0.2")}
+			for i, saddr := range saddrs {
+				fakeAddrs[i], _ = n.handle(saddr, daddr, true)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					n.handle(saddrs[i%flows], daddr, false)
+					n.handle(listenerAddr, fakeAddrs[i%flows], false)
+				}
+			})
+		})
+
+		b.Run("natTable/"+strconv.Itoa(flows), func(b *testing.B) {
+			table := newNATTable(testNATPool, DefaultMaxTCPEntries)
+			now := time.Now()
+			for i, saddr := range saddrs {
+				fakeAddrs[i], _ = table.insert(saddr, daddr, false, now, &DefaultTCPTimeouts)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					table.lookupSource(saddrs[i%flows], header.TCPFlagAck, now)
+					table.lookupFake(fakeAddrs[i%flows], header.TCPFlagAck, now)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkNATSynFlood(b *testing.B) {
+	daddr := netip.MustParseAddrPort("1.2.3.4:80")
+	// every SYN comes from the same port of a different address, so that the
+	// sync.Map probe collides with all previous fake ports
+	saddr := func(i int) netip.AddrPort {
+		return netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)}), 1234)
+	}
+
+	b.Run("syncMap", func(b *testing.B) {
+		n := &syncMapNAT{fakeIP: netip.MustParseAddr("10.0.0.2")}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if i%5000 == 0 {
+				n = &syncMapNAT{fakeIP: netip.MustParseAddr("10.0.0.2")}
+			}
+			n.handle(saddr(i), daddr, true)
+		}
+	})
+
+	b.Run("natTable", func(b *testing.B) {
+		table := newNATTable(testNATPool, DefaultMaxTCPEntries)
+		now := time.Now()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if i%5000 == 0 {
+				table.reset()
+			}
+			table.insert(saddr(i), daddr, false, now, &DefaultTCPTimeouts)
+		}
+	})
+}
@@ -0,0 +1,473 @@
+package tunat
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// netlinkConn a rtnetlink socket, every request waits for its ack
+type netlinkConn struct {
+	fd  int
+	seq uint32
+	buf []byte
+}
+
+func dialNetlink() (conn *netlinkConn, err error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	if err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	return &netlinkConn{fd: fd, buf: make([]byte, os.Getpagesize())}, nil
+}
+
+func (c *netlinkConn) Close() error {
+	return unix.Close(c.fd)
+}
+
+// send one message of msgType
+func (c *netlinkConn) send(msgType uint16, flags uint16, data []byte) (err error) {
+	c.seq++
+	msg := netlinkMessage(msgType, flags|unix.NLM_F_REQUEST, c.seq, data)
+	err = unix.Sendto(c.fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	if err != nil {
+		return os.NewSyscallError("sendto", err)
+	}
+	return nil
+}
+
+// receive the replies of the last message until handle returns true
+func (c *netlinkConn) receive(handle func(msg syscall.NetlinkMessage) (done bool, err error)) (err error) {
+	for {
+		nread, _, err := unix.Recvfrom(c.fd, c.buf, 0)
+		if err != nil {
+			return os.NewSyscallError("recvfrom", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(c.buf[:nread])
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			if msg.Header.Seq != c.seq {
+				continue
+			}
+			done, err := handle(msg)
+			if done || err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// request send one message of msgType and wait for its ack, the kernel
+// error is returned as a syscall.Errno
+func (c *netlinkConn) request(msgType uint16, flags uint16, data []byte) (err error) {
+	err = c.send(msgType, flags|unix.NLM_F_ACK, data)
+	if err != nil {
+		return
+	}
+	return c.receive(func(msg syscall.NetlinkMessage) (bool, error) {
+		if msg.Header.Type != unix.NLMSG_ERROR {
+			return false, nil
+		}
+		return true, netlinkError(msg)
+	})
+}
+
+// dump all objects of msgType, data of the returned messages is copied out of
+// the receive buffer
+func (c *netlinkConn) dump(msgType uint16, data []byte) (msgs []syscall.NetlinkMessage, err error) {
+	err = c.send(msgType, unix.NLM_F_DUMP, data)
+	if err != nil {
+		return
+	}
+	err = c.receive(func(msg syscall.NetlinkMessage) (bool, error) {
+		switch msg.Header.Type {
+		case unix.NLMSG_DONE:
+			return true, nil
+		case unix.NLMSG_ERROR:
+			return true, netlinkError(msg)
+		}
+		msg.Data = append([]byte(nil), msg.Data...)
+		msgs = append(msgs, msg)
+		return false, nil
+	})
+	return
+}
+
+func netlinkError(msg syscall.NetlinkMessage) error {
+	if len(msg.Data) < unix.SizeofNlMsgerr {
+		return syscall.EINVAL
+	}
+	if errno := (*unix.NlMsgerr)(unsafe.Pointer(&msg.Data[0])).Error; errno != 0 {
+		return syscall.Errno(-errno)
+	}
+	return nil
+}
+
+// netlinkMessage a nlmsghdr followed by data
+func netlinkMessage(msgType, flags uint16, seq uint32, data []byte) []byte {
+	msg := make([]byte, unix.SizeofNlMsghdr, unix.SizeofNlMsghdr+len(data))
+	*(*unix.NlMsghdr)(unsafe.Pointer(&msg[0])) = unix.NlMsghdr{
+		Len:   uint32(unix.SizeofNlMsghdr + len(data)),
+		Type:  msgType,
+		Flags: flags,
+		Seq:   seq,
+	}
+	return append(msg, data...)
+}
+
+// netlinkAttr append a rtattr to data, padded to 4 bytes
+func netlinkAttr(data []byte, attrType uint16, value []byte) []byte {
+	attr := make([]byte, unix.SizeofRtAttr, rtaAlign(unix.SizeofRtAttr+len(value)))
+	*(*unix.RtAttr)(unsafe.Pointer(&attr[0])) = unix.RtAttr{
+		Len:  uint16(unix.SizeofRtAttr + len(value)),
+		Type: attrType,
+	}
+	attr = append(attr, value...)
+	return append(data, attr[:cap(attr)]...)
+}
+
+func rtaAlign(length int) int {
+	return (length + unix.RTA_ALIGNTO - 1) &^ (unix.RTA_ALIGNTO - 1)
+}
+
+// nativeUint32 an attribute value in host byte order
+func nativeUint32(value uint32) []byte {
+	b := make([]byte, 4)
+	*(*uint32)(unsafe.Pointer(&b[0])) = value
+	return b
+}
+
+// structBytes the memory of a fixed size kernel struct
+func structBytes(p unsafe.Pointer, size uintptr) []byte {
+	return append([]byte(nil), unsafe.Slice((*byte)(p), size)...)
+}
+
+// setLinkUp set the link up and its mtu
+func (c *netlinkConn) setLinkUp(index int, mtu int) error {
+	msg := unix.IfInfomsg{
+		Family: unix.AF_UNSPEC,
+		Index:  int32(index),
+		Flags:  unix.IFF_UP,
+		Change: unix.IFF_UP,
+	}
+	data := structBytes(unsafe.Pointer(&msg), unix.SizeofIfInfomsg)
+	data = netlinkAttr(data, unix.IFLA_MTU, nativeUint32(uint32(mtu)))
+	return c.request(unix.RTM_NEWLINK, 0, data)
+}
+
+// replaceAddr like ip addr replace, ipv6 addresses skip duplicate address
+// detection so they are usable at once
+func (c *netlinkConn) replaceAddr(index int, prefix netip.Prefix) error {
+	msg := unix.IfAddrmsg{
+		Family:    unix.AF_INET,
+		Prefixlen: uint8(prefix.Bits()),
+		Scope:     unix.RT_SCOPE_UNIVERSE,
+		Index:     uint32(index),
+	}
+	if prefix.Addr().Is6() {
+		msg.Family = unix.AF_INET6
+		msg.Flags = unix.IFA_F_NODAD
+	}
+	data := structBytes(unsafe.Pointer(&msg), unix.SizeofIfAddrmsg)
+	data = netlinkAttr(data, unix.IFA_LOCAL, prefix.Addr().AsSlice())
+	data = netlinkAttr(data, unix.IFA_ADDRESS, prefix.Addr().AsSlice())
+	return c.request(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, data)
+}
+
+// replaceRoute like ip route replace, a RTN_UNICAST route leads prefix to the
+// device index, the lookup of a RTN_THROW route continues with the next rule
+func (c *netlinkConn) replaceRoute(table uint32, routeType uint8, prefix netip.Prefix, index int) error {
+	msg := unix.RtMsg{
+		Family:   routeFamily(prefix),
+		Dst_len:  uint8(prefix.Bits()),
+		Table:    unix.RT_TABLE_UNSPEC,
+		Protocol: unix.RTPROT_BOOT,
+		Scope:    unix.RT_SCOPE_UNIVERSE,
+		Type:     routeType,
+	}
+	if table < 256 {
+		msg.Table = uint8(table)
+	}
+	if routeType == unix.RTN_UNICAST {
+		msg.Scope = unix.RT_SCOPE_LINK
+	}
+	data := structBytes(unsafe.Pointer(&msg), unix.SizeofRtMsg)
+	data = netlinkAttr(data, unix.RTA_DST, prefix.Masked().Addr().AsSlice())
+	data = netlinkAttr(data, unix.RTA_TABLE, nativeUint32(table))
+	if index != 0 {
+		data = netlinkAttr(data, unix.RTA_OIF, nativeUint32(uint32(index)))
+	}
+	return c.request(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, data)
+}
+
+// flushTable delete all routes of table
+func (c *netlinkConn) flushTable(table uint32) (err error) {
+	msg := unix.RtMsg{Family: unix.AF_UNSPEC}
+	routes, err := c.dump(unix.RTM_GETROUTE, structBytes(unsafe.Pointer(&msg), unix.SizeofRtMsg))
+	if err != nil {
+		return
+	}
+	for _, route := range routes {
+		if route.Header.Type != unix.RTM_NEWROUTE || routeTable(route) != table {
+			continue
+		}
+		err = c.request(unix.RTM_DELROUTE, 0, route.Data)
+		if err != nil && err != syscall.ESRCH {
+			return
+		}
+	}
+	return nil
+}
+
+func routeTable(route syscall.NetlinkMessage) uint32 {
+	if len(route.Data) < unix.SizeofRtMsg {
+		return 0
+	}
+	if table, ok := parseNetlinkAttrs(route.Data[unix.SizeofRtMsg:])[unix.RTA_TABLE]; ok && len(table) == 4 {
+		return *(*uint32)(unsafe.Pointer(&table[0]))
+	}
+	return uint32((*unix.RtMsg)(unsafe.Pointer(&route.Data[0])).Table)
+}
+
+// parseNetlinkAttrs the rtattrs of data by type, unlike
+// syscall.ParseNetlinkRouteAttr it does not depend on the message type
+func parseNetlinkAttrs(data []byte) map[uint16][]byte {
+	attrs := make(map[uint16][]byte)
+	for len(data) >= unix.SizeofRtAttr {
+		attr := (*unix.RtAttr)(unsafe.Pointer(&data[0]))
+		if int(attr.Len) < unix.SizeofRtAttr || int(attr.Len) > len(data) {
+			break
+		}
+		attrs[attr.Type] = data[unix.SizeofRtAttr:attr.Len]
+		if rtaAlign(int(attr.Len)) > len(data) {
+			break
+		}
+		data = data[rtaAlign(int(attr.Len)):]
+	}
+	return attrs
+}
+
+// routeGet like ip route get addr mark mark oif oif, returns the output
+// interface index
+func (c *netlinkConn) routeGet(addr netip.Addr, mark uint32, oif int) (index int, err error) {
+	msg := unix.RtMsg{
+		Family:  unix.AF_INET,
+		Dst_len: uint8(addr.BitLen()),
+	}
+	if addr.Is6() {
+		msg.Family = unix.AF_INET6
+	}
+	data := structBytes(unsafe.Pointer(&msg), unix.SizeofRtMsg)
+	data = netlinkAttr(data, unix.RTA_DST, addr.AsSlice())
+	if mark != 0 {
+		data = netlinkAttr(data, unix.RTA_MARK, nativeUint32(mark))
+	}
+	if oif != 0 {
+		data = netlinkAttr(data, unix.RTA_OIF, nativeUint32(uint32(oif)))
+	}
+	err = c.send(unix.RTM_GETROUTE, 0, data)
+	if err != nil {
+		return
+	}
+	err = c.receive(func(msg syscall.NetlinkMessage) (bool, error) {
+		switch msg.Header.Type {
+		case unix.NLMSG_ERROR:
+			return true, netlinkError(msg)
+		case unix.RTM_NEWROUTE:
+			if len(msg.Data) < unix.SizeofRtMsg {
+				return true, syscall.EINVAL
+			}
+			value := parseNetlinkAttrs(msg.Data[unix.SizeofRtMsg:])[unix.RTA_OIF]
+			if len(value) == 4 {
+				index = int(*(*uint32)(unsafe.Pointer(&value[0])))
+			}
+			return true, nil
+		}
+		return false, nil
+	})
+	return
+}
+
+// fibRuleHdr struct fib_rule_hdr of linux/fib_rules.h
+type fibRuleHdr struct {
+	Family uint8
+	DstLen uint8
+	SrcLen uint8
+	Tos    uint8
+	Table  uint8
+	Res1   uint8
+	Res2   uint8
+	Action uint8
+	Flags  uint32
+}
+
+const sizeofFibRuleHdr = 12
+
+// addRule like ip rule add not fwmark mark lookup table priority priority,
+// sockets with mark keep the main table
+func (c *netlinkConn) addRule(family uint8, table, priority, mark uint32) error {
+	hdr := fibRuleHdr{
+		Family: family,
+		Action: unix.FR_ACT_TO_TBL,
+		Flags:  unix.FIB_RULE_INVERT,
+	}
+	data := structBytes(unsafe.Pointer(&hdr), sizeofFibRuleHdr)
+	data = netlinkAttr(data, unix.FRA_TABLE, nativeUint32(table))
+	data = netlinkAttr(data, unix.FRA_PRIORITY, nativeUint32(priority))
+	data = netlinkAttr(data, unix.FRA_FWMARK, nativeUint32(mark))
+	data = netlinkAttr(data, unix.FRA_FWMASK, nativeUint32(0xffffffff))
+	return c.request(unix.RTM_NEWRULE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, data)
+}
+
+// delRules delete the rules of family looking up table at priority, whatever
+// their mark
+func (c *netlinkConn) delRules(family uint8, table, priority uint32) (err error) {
+	hdr := fibRuleHdr{Family: family}
+	data := structBytes(unsafe.Pointer(&hdr), sizeofFibRuleHdr)
+	data = netlinkAttr(data, unix.FRA_TABLE, nativeUint32(table))
+	data = netlinkAttr(data, unix.FRA_PRIORITY, nativeUint32(priority))
+	for {
+		err = c.request(unix.RTM_DELRULE, 0, data)
+		if err == syscall.ENOENT {
+			return nil
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// configureDevice set the device up with its MTU, the addresses of the
+// prefixes and the routes, as Options.Configure. unconfigure removes what
+// AutoRoute added, the rest goes away with the device
+func configureDevice(opts *Options) (unconfigure func() error, err error) {
+	if !opts.Configure {
+		return nil, nil
+	}
+	iface, err := net.InterfaceByName(opts.DeviceName)
+	if err != nil {
+		return nil, fmt.Errorf("tunat configure: %w", err)
+	}
+	conn, err := dialNetlink()
+	if err != nil {
+		return nil, fmt.Errorf("tunat configure: %w", err)
+	}
+	defer conn.Close()
+
+	err = conn.setLinkUp(iface.Index, opts.MTU)
+	if err != nil {
+		return nil, fmt.Errorf("tunat configure: set %s up with mtu %d: %w", opts.DeviceName, opts.MTU, err)
+	}
+	for _, prefix := range []netip.Prefix{opts.IPv4Prefix, opts.IPv6Prefix} {
+		if !prefix.IsValid() {
+			continue
+		}
+		err = conn.replaceAddr(iface.Index, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("tunat configure: add address %v: %w", prefix, err)
+		}
+	}
+	if opts.AutoRoute {
+		return autoRoute(conn, opts, iface.Index)
+	}
+	for _, route := range opts.Routes {
+		err = conn.replaceRoute(unix.RT_TABLE_MAIN, unix.RTN_UNICAST, route, iface.Index)
+		if err != nil {
+			return nil, fmt.Errorf("tunat configure: add route %v: %w", route, err)
+		}
+	}
+	return nil, nil
+}
+
+// autoRoute route Routes, or all addresses of the families of the prefixes,
+// to the device in AutoRouteTable except ExcludeRoutes. Every socket without
+// AutoRouteMark looks up AutoRouteTable. What a crashed process left is
+// removed first
+func autoRoute(conn *netlinkConn, opts *Options, index int) (unconfigure func() error, err error) {
+	table, priority := uint32(opts.AutoRouteTable), uint32(opts.AutoRoutePriority)
+	unconfigure = func() error {
+		conn, err := dialNetlink()
+		if err != nil {
+			return fmt.Errorf("tunat auto route: %w", err)
+		}
+		defer conn.Close()
+		return cleanupAutoRoute(conn, table, priority)
+	}
+	err = cleanupAutoRoute(conn, table, priority)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			cleanupAutoRoute(conn, table, priority)
+		}
+	}()
+
+	routes := opts.Routes
+	if len(routes) == 0 {
+		if opts.IPv4Prefix.IsValid() {
+			routes = append(routes, netip.PrefixFrom(netip.IPv4Unspecified(), 0))
+		}
+		if opts.IPv6Prefix.IsValid() {
+			routes = append(routes, netip.PrefixFrom(netip.IPv6Unspecified(), 0))
+		}
+	}
+	families := map[uint8]bool{}
+	for _, route := range routes {
+		err = conn.replaceRoute(table, unix.RTN_UNICAST, route, index)
+		if err != nil {
+			return nil, fmt.Errorf("tunat auto route: add route %v: %w", route, err)
+		}
+		families[routeFamily(route)] = true
+	}
+	for _, route := range opts.ExcludeRoutes {
+		err = conn.replaceRoute(table, unix.RTN_THROW, route, 0)
+		if err != nil {
+			return nil, fmt.Errorf("tunat auto route: exclude route %v: %w", route, err)
+		}
+	}
+	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		if !families[family] {
+			continue
+		}
+		err = conn.addRule(family, table, priority, opts.AutoRouteMark)
+		if err != nil {
+			return nil, fmt.Errorf("tunat auto route: add rule: %w", err)
+		}
+	}
+	return unconfigure, nil
+}
+
+// cleanupAutoRoute delete the rules at priority and flush table
+func cleanupAutoRoute(conn *netlinkConn, table, priority uint32) (err error) {
+	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		err = conn.delRules(family, table, priority)
+		if err != nil {
+			return fmt.Errorf("tunat auto route: delete rules: %w", err)
+		}
+	}
+	err = conn.flushTable(table)
+	if err != nil {
+		return fmt.Errorf("tunat auto route: flush table %d: %w", table, err)
+	}
+	return nil
+}
+
+func routeFamily(prefix netip.Prefix) uint8 {
+	if prefix.Addr().Is6() {
+		return unix.AF_INET6
+	}
+	return unix.AF_INET
+}
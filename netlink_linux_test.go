@@ -0,0 +1,279 @@
+package tunat
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNetlinkMessage(t *testing.T) {
+	msg := unix.IfAddrmsg{Family: unix.AF_INET6, Prefixlen: 120, Index: 7}
+	data := structBytes(unsafe.Pointer(&msg), unix.SizeofIfAddrmsg)
+	data = netlinkAttr(data, unix.IFA_LOCAL, netip.MustParseAddr("fd::1").AsSlice())
+	data = netlinkAttr(data, unix.IFA_FLAGS, []byte{1, 2, 3})
+	data = netlinkAttr(data, unix.IFA_LABEL, []byte("tun1\x00"))
+
+	msgs, err := syscall.ParseNetlinkMessage(netlinkMessage(unix.RTM_NEWADDR, unix.NLM_F_REQUEST, 3, data))
+	if err != nil || len(msgs) != 1 {
+		t.Fatal(msgs, err)
+	}
+	if msgs[0].Header.Type != unix.RTM_NEWADDR || msgs[0].Header.Seq != 3 || msgs[0].Header.Len%4 != 0 {
+		t.Fatalf("header %+v", msgs[0].Header)
+	}
+	parsed := (*unix.IfAddrmsg)(unsafe.Pointer(&msgs[0].Data[0]))
+	if *parsed != msg {
+		t.Fatalf("ifaddrmsg %+v", *parsed)
+	}
+	attrs, err := syscall.ParseNetlinkRouteAttr(&msgs[0])
+	if err != nil || len(attrs) != 3 {
+		t.Fatal(attrs, err)
+	}
+	if attrs[0].Attr.Type != unix.IFA_LOCAL || string(attrs[0].Value) != string(netip.MustParseAddr("fd::1").AsSlice()) ||
+		attrs[1].Attr.Type != unix.IFA_FLAGS || string(attrs[1].Value) != "\x01\x02\x03" ||
+		attrs[2].Attr.Type != unix.IFA_LABEL || string(attrs[2].Value) != "tun1\x00" {
+		t.Fatalf("attributes %+v", attrs)
+	}
+}
+
+func TestConfigureDevice(t *testing.T) {
+	if unix.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	tn, err := NewWithOptions(
+		WithDeviceName("tunat-conf"),
+		WithIPv4Prefix(netip.MustParsePrefix("10.9.0.1/24")),
+		WithIPv6Prefix(netip.MustParsePrefix("fd09::1/120")),
+		WithMTU(1400),
+		WithConfigure(true),
+		WithRoutes(netip.MustParsePrefix("10.9.1.0/24"), netip.MustParsePrefix("fd09:1::/64")),
+	)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer tn.Close()
+
+	iface, err := net.InterfaceByName("tunat-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iface.MTU != 1400 || iface.Flags&net.FlagUp == 0 {
+		t.Fatalf("interface %+v", iface)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found int
+	for _, addr := range addrs {
+		switch addr.String() {
+		case "10.9.0.1/24", "fd09::1/120":
+			found++
+		}
+	}
+	if found != 2 {
+		t.Fatalf("addresses %v", addrs)
+	}
+
+	// the routes lead to the device
+	tn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 100)
+	for _, daddr := range []string{"10.9.1.5:53", "[fd09:1::5]:53"} {
+		conn, err := net.Dial("udp", daddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte("abcd"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nread, _, readDaddr, err := tn.ReadFromUDPAddrPort(buf)
+		if err != nil || string(buf[:nread]) != "abcd" || readDaddr.String() != daddr {
+			t.Fatalf("read %q %v %v", buf[:nread], readDaddr, err)
+		}
+	}
+}
+
+// autoRouteState count the routes of table and the rules at priority
+func autoRouteState(t *testing.T, table, priority uint32) (routes, rules int) {
+	t.Helper()
+
+	conn, err := dialNetlink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	rtmsg := unix.RtMsg{Family: unix.AF_UNSPEC}
+	msgs, err := conn.dump(unix.RTM_GETROUTE, structBytes(unsafe.Pointer(&rtmsg), unix.SizeofRtMsg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range msgs {
+		if routeTable(msg) == table {
+			routes++
+		}
+	}
+
+	hdr := fibRuleHdr{Family: unix.AF_UNSPEC}
+	msgs, err = conn.dump(unix.RTM_GETRULE, structBytes(unsafe.Pointer(&hdr), sizeofFibRuleHdr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range msgs {
+		value := parseNetlinkAttrs(msg.Data[sizeofFibRuleHdr:])[unix.FRA_PRIORITY]
+		if len(value) == 4 && *(*uint32)(unsafe.Pointer(&value[0])) == priority {
+			rules++
+		}
+	}
+	return
+}
+
+func TestAutoRoute(t *testing.T) {
+	if unix.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	const table, priority = 2099, 9099
+
+	// left by a crashed process
+	conn, err := dialNetlink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	defer cleanupAutoRoute(conn, table, priority)
+	err = conn.replaceRoute(table, unix.RTN_THROW, netip.MustParsePrefix("10.9.9.0/24"), 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	err = conn.addRule(unix.AF_INET, table, priority, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tn, err := NewWithOptions(
+		WithDeviceName("tunat-route"),
+		WithIPv4Prefix(netip.MustParsePrefix("10.9.0.1/24")),
+		WithIPv6Prefix(netip.MustParsePrefix("fd09::1/120")),
+		WithConfigure(true),
+		WithAutoRoute(true),
+		WithAutoRouteTable(table),
+		WithAutoRoutePriority(priority),
+		WithRoutes(netip.MustParsePrefix("10.9.2.0/24"), netip.MustParsePrefix("fd09:2::/64")),
+		WithExcludeRoutes(netip.MustParsePrefix("10.9.2.128/25")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routes, rules := autoRouteState(t, table, priority); routes != 3 || rules != 2 {
+		t.Fatalf("%d routes, %d rules", routes, rules)
+	}
+
+	// sockets without the mark look up the table, the excluded half of
+	// 10.9.2.0/24 goes elsewhere
+	tn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 100)
+	for _, daddr := range []string{"10.9.2.130:53", "10.9.2.5:53"} {
+		udpConn, err := net.Dial("udp", daddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer udpConn.Close()
+		_, err = udpConn.Write([]byte(daddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	nread, _, readDaddr, err := tn.ReadFromUDPAddrPort(buf)
+	if err != nil || readDaddr.String() != "10.9.2.5:53" || string(buf[:nread]) != "10.9.2.5:53" {
+		t.Fatalf("read %q %v %v", buf[:nread], readDaddr, err)
+	}
+
+	err = tn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routes, rules := autoRouteState(t, table, priority); routes != 0 || rules != 0 {
+		t.Fatalf("%d routes, %d rules left", routes, rules)
+	}
+}
+
+func TestOutboundDialerRoute(t *testing.T) {
+	if unix.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	const table, priority = 2098, 9098
+	tn, err := NewWithOptions(
+		WithDeviceName("tunat-dial"),
+		WithIPv4Prefix(netip.MustParsePrefix("10.9.0.1/24")),
+		WithConfigure(true),
+		WithAutoRoute(true),
+		WithAutoRouteTable(table),
+		WithAutoRoutePriority(priority),
+		WithRoutes(netip.MustParsePrefix("10.9.6.0/24")),
+	)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer tn.Close()
+
+	// without the mark 10.9.6.0/24 is routed to the device
+	for _, dialer := range []*OutboundDialer{
+		{LoopDevice: "tunat-dial"},
+		{Interface: "tunat-dial", LoopDevice: "tunat-dial"},
+	} {
+		_, err = dialer.Dial("udp", "10.9.6.5:53")
+		if !errors.Is(err, ErrLoop) {
+			t.Fatalf("dial with %+v: %v", dialer, err)
+		}
+	}
+
+	// the mark of AutoRoute keeps the main table, or lo is not the device
+	for _, dialer := range []*OutboundDialer{
+		tn.OutboundDialer(),
+		{Interface: "lo", LoopDevice: "tunat-dial"},
+	} {
+		conn, err := dialer.Dial("udp", "10.9.6.5:53")
+		if err != nil {
+			t.Fatalf("dial with %+v: %v", dialer, err)
+		}
+		conn.Close()
+	}
+	_, err = tn.OutboundDialer().Dial("udp", "10.9.0.5:53")
+	if !errors.Is(err, ErrLoop) {
+		t.Fatalf("dial the tun prefix: %v", err)
+	}
+
+	// the route is looked up once per destination over one netlink socket
+	dialer := &OutboundDialer{LoopDevice: "tunat-dial"}
+	packetConn, err := dialer.ListenPacket(context.Background(), "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packetConn.Close()
+	for i := 0; i < 3; i++ {
+		_, err = packetConn.WriteTo([]byte("abcd"), &net.UDPAddr{IP: net.IPv4(10, 9, 6, 5), Port: 53})
+		if !errors.Is(err, ErrLoop) {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+	routeConn.mutex.Lock()
+	conn := routeConn.conn
+	routeConn.mutex.Unlock()
+	if len(dialer.loopRoutes) != 1 || conn == nil {
+		t.Fatalf("%d cached routes, netlink socket %v", len(dialer.loopRoutes), conn)
+	}
+
+	// a failed lookup refuses the dial
+	_, err = (&OutboundDialer{LoopDevice: "tunat-missing"}).Dial("udp", "10.9.6.5:53")
+	if err == nil {
+		t.Fatal("dial without knowing the route")
+	}
+}
@@ -0,0 +1,101 @@
+package tunat
+
+import (
+	"sync/atomic"
+
+	"github.com/FH0/tunat/device"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// maxOffloadPacket the largest GSO super-packet
+const maxOffloadPacket = 65535
+
+// offloadWorker like worker, TCP super-packets are NAT'd as a whole and
+// written back with their virtio_net_hdr, UDP super-packets are split
+func (t *Tunat) offloadWorker(queue device.OffloadDevice) {
+	buf := make([]byte, maxOffloadPacket)
+	segment := make([]byte, maxOffloadPacket)
+	for {
+		hdr, nread, err := queue.ReadOffload(buf)
+		if err != nil {
+			t.readError(err)
+			return
+		}
+		t.handleOffload(hdr, buf[:nread], segment)
+	}
+}
+
+// handleOffload dispatch a packet read with its virtio_net_hdr, segment is
+// scratch space for handleUDPSegments
+func (t *Tunat) handleOffload(hdr device.VirtioNetHdr, packet, segment []byte) {
+	if hdr.GSOType == device.GSOUDPL4 {
+		t.handleUDPSegments(hdr, packet, segment)
+		return
+	}
+	t.handlePacket(packet, &hdr)
+}
+
+// handleUDPSegments split a UDP super-packet of UDP_SEGMENT into datagrams of
+// hdr.GSOSize bytes, their checksums are left partial
+func (t *Tunat) handleUDPSegments(hdr device.VirtioNetHdr, packet, segment []byte) {
+	udpStart := int(hdr.CsumStart)
+	headerLen := udpStart + header.UDPMinimumSize
+	if headerLen > len(packet) || hdr.GSOSize == 0 {
+		atomic.AddUint64(&t.stats.DroppedShortHeader, 1)
+		return
+	}
+	switch header.IPVersion(packet) {
+	case header.IPv4Version:
+		if udpStart < header.IPv4MinimumSize || int(header.IPv4(packet).HeaderLength()) != udpStart {
+			atomic.AddUint64(&t.stats.DroppedBadHeaderLength, 1)
+			return
+		}
+	case header.IPv6Version:
+		if udpStart < header.IPv6MinimumSize {
+			atomic.AddUint64(&t.stats.DroppedBadHeaderLength, 1)
+			return
+		}
+	default:
+		return
+	}
+
+	segmentHdr := device.VirtioNetHdr{
+		Flags:      device.VirtioNetHdrFNeedsCsum,
+		CsumStart:  hdr.CsumStart,
+		CsumOffset: hdr.CsumOffset,
+	}
+	for payload := packet[headerLen:]; len(payload) != 0; {
+		size := int(hdr.GSOSize)
+		if size > len(payload) {
+			size = len(payload)
+		}
+		datagram := segment[:headerLen+size]
+		copy(datagram, packet[:headerLen])
+		copy(datagram[headerLen:], payload[:size])
+		payload = payload[size:]
+
+		if header.IPVersion(datagram) == header.IPv4Version {
+			ipHeader := header.IPv4(datagram)
+			ipHeader.SetTotalLength(uint16(len(datagram)))
+			ipHeader.SetChecksum(0)
+			ipHeader.SetChecksum(^ipHeader.CalculateChecksum())
+		} else {
+			header.IPv6(datagram).SetPayloadLength(uint16(len(datagram) - header.IPv6MinimumSize))
+		}
+		header.UDP(datagram[udpStart:]).SetLength(uint16(header.UDPMinimumSize + size))
+		t.handlePacket(datagram, &segmentHdr)
+	}
+}
+
+// writeTCP write a NAT'd segment with the virtio_net_hdr it was read with
+func (t *Tunat) writeTCP(packet []byte, hdr *device.VirtioNetHdr) {
+	if hdr == nil || t.offload == nil {
+		_, _ = t.file.Write(packet)
+		return
+	}
+	_, _ = t.offload.WriteOffload(*hdr, packet)
+}
+
+func isPartial(hdr *device.VirtioNetHdr) bool {
+	return hdr != nil && hdr.Flags&device.VirtioNetHdrFNeedsCsum != 0
+}
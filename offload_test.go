@@ -0,0 +1,180 @@
+package tunat
+
+import (
+	"net/netip"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/FH0/tunat/device"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+type offloadPacket struct {
+	hdr    device.VirtioNetHdr
+	packet []byte
+}
+
+// offloadPipe an in-memory OffloadDevice, the test writes to rx and reads
+// from tx
+type offloadPipe struct {
+	rx        chan offloadPacket
+	tx        chan offloadPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newOffloadPipe() *offloadPipe {
+	return &offloadPipe{
+		rx:     make(chan offloadPacket, 64),
+		tx:     make(chan offloadPacket, 64),
+		closed: make(chan struct{}),
+	}
+}
+
+func (p *offloadPipe) ReadOffload(buf []byte) (device.VirtioNetHdr, int, error) {
+	select {
+	case packet := <-p.rx:
+		return packet.hdr, copy(buf, packet.packet), nil
+	case <-p.closed:
+		return device.VirtioNetHdr{}, 0, os.ErrClosed
+	}
+}
+
+func (p *offloadPipe) WriteOffload(hdr device.VirtioNetHdr, packet []byte) (int, error) {
+	select {
+	case p.tx <- offloadPacket{hdr, append([]byte(nil), packet...)}:
+		return len(packet), nil
+	case <-p.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+func (p *offloadPipe) Read(buf []byte) (int, error) {
+	hdr, nread, err := p.ReadOffload(buf)
+	device.CompleteChecksum(hdr, buf[:nread])
+	return nread, err
+}
+
+func (p *offloadPipe) Write(buf []byte) (int, error) {
+	return p.WriteOffload(device.VirtioNetHdr{}, buf)
+}
+
+func (p *offloadPipe) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+	return nil
+}
+
+func (p *offloadPipe) next(t *testing.T) offloadPacket {
+	t.Helper()
+
+	select {
+	case packet := <-p.tx:
+		return packet
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	return offloadPacket{}
+}
+
+// partialTCP a TCP segment whose checksum only covers the pseudo header, as
+// it is read from a device with checksum offload
+func partialTCP(saddr, daddr netip.AddrPort, flags header.TCPFlags, payload []byte) (device.VirtioNetHdr, []byte) {
+	packet := buildTCP(saddr, daddr, flags, payload)
+	ipHeaderLen := header.IPv4MinimumSize
+	if saddr.Addr().Is6() {
+		ipHeaderLen = header.IPv6MinimumSize
+	}
+	tcpHeader := header.TCP(packet[ipHeaderLen:])
+	tcpHeader.SetChecksum(header.PseudoHeaderChecksum(
+		header.TCPProtocolNumber,
+		tcpip.Address(saddr.Addr().AsSlice()),
+		tcpip.Address(daddr.Addr().AsSlice()),
+		uint16(len(tcpHeader)),
+	))
+	return device.VirtioNetHdr{
+		Flags:      device.VirtioNetHdrFNeedsCsum,
+		HdrLen:     uint16(ipHeaderLen + header.TCPMinimumSize),
+		CsumStart:  uint16(ipHeaderLen),
+		CsumOffset: 16,
+	}, packet
+}
+
+func TestOffloadTCP(t *testing.T) {
+	dev := newOffloadPipe()
+	tn, _ := newTunatWithOptions(t, WithDevice(dev))
+
+	for _, tt := range []struct {
+		name    string
+		saddr   netip.AddrPort
+		daddr   netip.AddrPort
+		gsoType uint8
+	}{
+		{"ipv4", netip.MustParseAddrPort("10.0.0.1:1234"), netip.MustParseAddrPort("1.2.3.4:80"), device.GSOTCPv4},
+		{"ipv6", netip.MustParseAddrPort("[fd::1]:1234"), netip.MustParseAddrPort("[2001:db8::1]:80"), device.GSOTCPv6},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dev.rx <- offloadPacket{device.VirtioNetHdr{}, buildTCP(tt.saddr, tt.daddr, header.TCPFlagSyn, nil)}
+			syn := dev.next(t)
+			if syn.hdr != (device.VirtioNetHdr{}) {
+				t.Fatalf("hdr %+v", syn.hdr)
+			}
+			fakeAddr, listenerAddr, _ := parseTCP(t, syn.packet)
+
+			// a TSO super-packet keeps its hdr and its checksum stays partial
+			hdr, packet := partialTCP(tt.saddr, tt.daddr, header.TCPFlagAck, make([]byte, 4000))
+			hdr.GSOType, hdr.GSOSize = tt.gsoType, 1400
+			dev.rx <- offloadPacket{hdr, packet}
+			rewritten := dev.next(t)
+			if rewritten.hdr != hdr || len(rewritten.packet) != len(packet) {
+				t.Fatalf("hdr %+v, %d bytes", rewritten.hdr, len(rewritten.packet))
+			}
+			wantHdr, want := partialTCP(fakeAddr, listenerAddr, header.TCPFlagAck, make([]byte, 4000))
+			if rewritten.hdr.CsumStart != wantHdr.CsumStart || string(rewritten.packet) != string(want) {
+				t.Fatalf("rewritten\n%x\nwant\n%x", rewritten.packet[:60], want[:60])
+			}
+			device.CompleteChecksum(rewritten.hdr, rewritten.packet)
+			parseTCP(t, rewritten.packet)
+		})
+	}
+	if tn.Stats().DroppedBadChecksum != 0 {
+		t.Fatal("partial checksum dropped")
+	}
+}
+
+func TestOffloadUDP(t *testing.T) {
+	dev := newOffloadPipe()
+	tn, _ := newTunatWithOptions(t, WithDevice(dev), WithVerifyChecksums(true))
+	saddr := netip.MustParseAddrPort("[fd::1]:1234")
+	daddr := netip.MustParseAddrPort("[2001:db8::1]:53")
+
+	// a USO super-packet of 3 datagrams, the last one shorter
+	payload := make([]byte, 250)
+	for i := range payload {
+		payload[i] = byte(i / 100)
+	}
+	packet := buildUDP(saddr, daddr, payload)
+	dev.rx <- offloadPacket{device.VirtioNetHdr{
+		Flags:      device.VirtioNetHdrFNeedsCsum,
+		GSOType:    device.GSOUDPL4,
+		HdrLen:     header.IPv6MinimumSize + header.UDPMinimumSize,
+		GSOSize:    100,
+		CsumStart:  header.IPv6MinimumSize,
+		CsumOffset: 6,
+	}, packet}
+
+	buf := make([]byte, 1500)
+	for i, size := range []int{100, 100, 50} {
+		nread, readSaddr, readDaddr, err := tn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nread != size || buf[0] != byte(i) || buf[nread-1] != byte(i) || readSaddr != saddr || readDaddr != daddr {
+			t.Fatalf("datagram %d: %d bytes %v -> %v", i, nread, readSaddr, readDaddr)
+		}
+	}
+}
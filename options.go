@@ -0,0 +1,590 @@
+package tunat
+
+import (
+	"log"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/FH0/tunat/device"
+)
+
+// Logger report background errors, *log.Logger satisfies it
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Options all knobs of a Tunat, exactly one device source must be set
+type Options struct {
+	// Device use an existing device, Close waits until its Read returns
+	Device device.Device
+	// Devices use the existing queues of one device, each is read by its own
+	// worker, such as the files of device.NewMultiQueue
+	Devices []device.Device
+	// DeviceName create a tun device with this name
+	DeviceName string
+	// Queues number of queues of the device created with DeviceName, more
+	// than one opens it with IFF_MULTI_QUEUE, linux only
+	Queues int
+	// Offload open the device created with DeviceName with IFF_VNET_HDR, TCP
+	// segments are read and NAT'd up to 64KB at a time, linux only
+	Offload bool
+	// UnixSocketPath receive the tun fd from this unix socket, linux only
+	UnixSocketPath string
+
+	// IPv4Prefix address of the tun device, at least one prefix is required
+	IPv4Prefix netip.Prefix
+	// IPv6Prefix address of the tun device, at least one prefix is required
+	IPv6Prefix netip.Prefix
+	// FakeIPv4Pool fake source addresses of NAT'd ipv4 connections, must be
+	// inside IPv4Prefix, defaults to the whole IPv4Prefix
+	FakeIPv4Pool netip.Prefix
+	// FakeIPv6Pool fake source addresses of NAT'd ipv6 connections, must be
+	// inside IPv6Prefix, defaults to the whole IPv6Prefix
+	FakeIPv6Pool netip.Prefix
+	// MTU the largest packet read from the device
+	MTU int
+	// ListenAddr address of the internal TCP listener, empty binds one
+	// listener to the tun address of each prefix
+	ListenAddr string
+	// Listener use an existing TCP listener instead of ListenAddr, it is
+	// closed by Close like Device
+	Listener net.Listener
+	// UDPQueueSize number of UDP packets waiting for ReadFromUDPAddrPort,
+	// also per UDPSession and of sessions waiting for AcceptUDP
+	UDPQueueSize int
+	// UDPDropPolicy which packet is dropped when a UDP queue is full, the
+	// device is never blocked by a slow UDP reader
+	UDPDropPolicy UDPDropPolicy
+	// UDPSessionTimeout idle timeout of UDP sessions
+	UDPSessionTimeout time.Duration
+	// MaxUDPSessions capacity of the UDP session table, packets of new flows
+	// are dropped beyond it
+	MaxUDPSessions int
+	// ReassemblyTimeout drop a fragmented packet whose fragments did not all
+	// arrive within it
+	ReassemblyTimeout time.Duration
+	// MaxReassemblyBytes memory bound of fragments waiting for reassembly,
+	// the oldest packets are dropped beyond it
+	MaxReassemblyBytes int
+	// MaxReassemblyPackets number of fragmented packets waiting for
+	// reassembly, the oldest packets are dropped beyond it
+	MaxReassemblyPackets int
+	// VerifyChecksums drop packets with a bad IPv4, TCP or UDP checksum
+	// instead of forwarding them
+	VerifyChecksums bool
+	// Logger report background errors
+	Logger Logger
+	// TCPTimeouts idle timeouts of tcp nat map entries
+	TCPTimeouts TCPTimeouts
+	// MaxTCPEntries capacity of the tcp nat map of each ip family, finished or
+	// idle entries are evicted beyond it, new connections are rejected with
+	// RejectNoFreeAddress if there is none
+	MaxTCPEntries int
+	// RejectPolicy choose to reject or drop TCP packets that can not be
+	// NAT'd, nil rejects all of them
+	RejectPolicy RejectPolicy
+	// RejectMethod how TCP packets are rejected, defaults to RejectWithTCPReset
+	RejectMethod RejectMethod
+	// AdmissionPolicy decide each new TCP flow, nil accepts all of them
+	AdmissionPolicy AdmissionPolicy
+	// PassthroughDialer dial the original destination of passthrough flows,
+	// nil dials with Tunat.OutboundDialer
+	PassthroughDialer Dialer
+
+	// Configure set the device created with DeviceName up with MTU, add the
+	// addresses of the prefixes and Routes over rtnetlink, linux only
+	Configure bool
+	// Routes routed to the device by Configure, such as 0.0.0.0/0
+	Routes []netip.Prefix
+	// AutoRoute put Routes, defaulting to all addresses of the families of
+	// the prefixes, in AutoRouteTable, looked up by every socket without
+	// AutoRouteMark. It is removed by Close and by the next start after a
+	// crash, requires Configure
+	AutoRoute bool
+	// AutoRouteTable routing table dedicated to AutoRoute, it is flushed
+	AutoRouteTable int
+	// AutoRoutePriority priority of the ip rules of AutoRoute
+	AutoRoutePriority int
+	// AutoRouteMark fwmark of the sockets that bypass AutoRoute, such as the
+	// sockets of Tunat.OutboundDialer
+	AutoRouteMark uint32
+	// ExcludeRoutes destinations that bypass AutoRoute, such as the LAN
+	ExcludeRoutes []netip.Prefix
+
+	// PreCommands bash commands executed before the device is opened
+	PreCommands []string
+	// PostCommands bash commands executed after the device is opened and
+	// configured
+	PostCommands []string
+}
+
+// Option modify Options
+type Option func(*Options)
+
+// OptionError returned when Options are invalid
+type OptionError struct {
+	Option string
+	Reason string
+}
+
+func (e *OptionError) Error() string {
+	return "tunat: invalid option " + e.Option + ": " + e.Reason
+}
+
+// defaults of AutoRoute
+const (
+	DefaultAutoRouteTable    = 2022
+	DefaultAutoRoutePriority = 9000
+	DefaultAutoRouteMark     = 0x2022
+)
+
+// autoRouteMark the mark of the sockets of Tunat.OutboundDialer
+func autoRouteMark(o *Options) uint32 {
+	if !o.AutoRoute {
+		return 0
+	}
+	return o.AutoRouteMark
+}
+
+func defaultOptions() Options {
+	return Options{
+		MTU:                  1500,
+		Queues:               1,
+		UDPQueueSize:         100,
+		UDPSessionTimeout:    DefaultUDPSessionTimeout,
+		MaxUDPSessions:       DefaultMaxUDPSessions,
+		ReassemblyTimeout:    DefaultReassemblyTimeout,
+		MaxReassemblyBytes:   DefaultMaxReassemblyBytes,
+		MaxReassemblyPackets: DefaultMaxReassemblyPackets,
+		Logger:               log.Default(),
+		TCPTimeouts:          DefaultTCPTimeouts,
+		MaxTCPEntries:        DefaultMaxTCPEntries,
+		AutoRouteTable:       DefaultAutoRouteTable,
+		AutoRoutePriority:    DefaultAutoRoutePriority,
+		AutoRouteMark:        DefaultAutoRouteMark,
+	}
+}
+
+func (o *Options) validate() error {
+	var deviceSources int
+	if o.Device != nil {
+		deviceSources++
+	}
+	if len(o.Devices) != 0 {
+		deviceSources++
+	}
+	if o.DeviceName != "" {
+		deviceSources++
+	}
+	if o.UnixSocketPath != "" {
+		deviceSources++
+	}
+	if deviceSources != 1 {
+		return &OptionError{"Device", "exactly one of Device, Devices, DeviceName and UnixSocketPath must be set"}
+	}
+	for _, dev := range o.Devices {
+		if dev == nil {
+			return &OptionError{"Devices", "must not be nil"}
+		}
+	}
+	if err := o.validatePlatform(); err != nil {
+		return err
+	}
+	if o.Queues <= 0 {
+		return &OptionError{"Queues", "must be positive"}
+	}
+	if o.Queues > 1 && o.DeviceName == "" {
+		return &OptionError{"Queues", "only applies to DeviceName"}
+	}
+	if o.Offload && o.DeviceName == "" {
+		return &OptionError{"Offload", "only applies to DeviceName"}
+	}
+	if o.Configure && o.DeviceName == "" {
+		return &OptionError{"Configure", "only applies to DeviceName"}
+	}
+	if len(o.Routes) != 0 && !o.Configure {
+		return &OptionError{"Routes", "requires Configure"}
+	}
+	for _, route := range o.Routes {
+		if !route.IsValid() || route.Addr().Is4In6() {
+			return &OptionError{"Routes", "invalid prefix " + route.String()}
+		}
+	}
+	if o.AutoRoute && !o.Configure {
+		return &OptionError{"AutoRoute", "requires Configure"}
+	}
+	// 253 to 255 are the default, main and local tables
+	if o.AutoRouteTable <= 0 || o.AutoRouteTable >= 253 && o.AutoRouteTable <= 255 ||
+		int64(o.AutoRouteTable) > 0xffffffff {
+		return &OptionError{"AutoRouteTable", "must be positive and not a reserved table"}
+	}
+	// 0, 32766 and 32767 are the rules of the local, main and default tables
+	if o.AutoRoutePriority <= 0 || o.AutoRoutePriority >= 32766 {
+		return &OptionError{"AutoRoutePriority", "must be between 1 and 32765"}
+	}
+	if o.AutoRouteMark == 0 {
+		return &OptionError{"AutoRouteMark", "must not be 0"}
+	}
+	if len(o.ExcludeRoutes) != 0 && !o.AutoRoute {
+		return &OptionError{"ExcludeRoutes", "requires AutoRoute"}
+	}
+	for _, route := range o.ExcludeRoutes {
+		if !route.IsValid() || route.Addr().Is4In6() {
+			return &OptionError{"ExcludeRoutes", "invalid prefix " + route.String()}
+		}
+	}
+
+	if !o.IPv4Prefix.IsValid() && !o.IPv6Prefix.IsValid() {
+		return &OptionError{"IPv4Prefix", "at least one of IPv4Prefix and IPv6Prefix must be set"}
+	}
+	if o.IPv4Prefix.IsValid() {
+		if !o.IPv4Prefix.Addr().Is4() {
+			return &OptionError{"IPv4Prefix", "not an ipv4 prefix"}
+		}
+		if !o.FakeIPv4Pool.IsValid() {
+			o.FakeIPv4Pool = o.IPv4Prefix
+		}
+		if err := validatePool("FakeIPv4Pool", o.FakeIPv4Pool, o.IPv4Prefix); err != nil {
+			return err
+		}
+	}
+	if o.IPv6Prefix.IsValid() {
+		if !o.IPv6Prefix.Addr().Is6() || o.IPv6Prefix.Addr().Is4In6() {
+			return &OptionError{"IPv6Prefix", "not an ipv6 prefix"}
+		}
+		if !o.FakeIPv6Pool.IsValid() {
+			o.FakeIPv6Pool = o.IPv6Prefix
+		}
+		if err := validatePool("FakeIPv6Pool", o.FakeIPv6Pool, o.IPv6Prefix); err != nil {
+			return err
+		}
+	}
+
+	if o.MTU < 68 || o.MTU > 65535 {
+		return &OptionError{"MTU", "must be between 68 and 65535"}
+	}
+	if o.ListenAddr != "" {
+		if _, err := netip.ParseAddrPort(o.ListenAddr); err != nil {
+			return &OptionError{"ListenAddr", err.Error()}
+		}
+	}
+	if o.Listener != nil {
+		if o.ListenAddr != "" {
+			return &OptionError{"Listener", "ListenAddr and Listener can not be both set"}
+		}
+		if _, ok := o.Listener.Addr().(*net.TCPAddr); !ok {
+			return &OptionError{"Listener", "not a TCP listener"}
+		}
+	}
+	if o.UDPQueueSize <= 0 {
+		return &OptionError{"UDPQueueSize", "must be positive"}
+	}
+	if o.UDPDropPolicy != UDPDropNewest && o.UDPDropPolicy != UDPDropOldest {
+		return &OptionError{"UDPDropPolicy", "unknown policy"}
+	}
+	if o.UDPSessionTimeout <= 0 {
+		return &OptionError{"UDPSessionTimeout", "must be positive"}
+	}
+	if o.MaxUDPSessions <= 0 {
+		return &OptionError{"MaxUDPSessions", "must be positive"}
+	}
+	if o.ReassemblyTimeout <= 0 {
+		return &OptionError{"ReassemblyTimeout", "must be positive"}
+	}
+	if o.MaxReassemblyBytes <= 0 {
+		return &OptionError{"MaxReassemblyBytes", "must be positive"}
+	}
+	if o.MaxReassemblyPackets <= 0 {
+		return &OptionError{"MaxReassemblyPackets", "must be positive"}
+	}
+	if o.TCPTimeouts.SynSent <= 0 ||
+		o.TCPTimeouts.Established <= 0 ||
+		o.TCPTimeouts.FinWait <= 0 ||
+		o.TCPTimeouts.TimeWait <= 0 ||
+		o.TCPTimeouts.Close <= 0 {
+		return &OptionError{"TCPTimeouts", "must be positive"}
+	}
+	if o.MaxTCPEntries <= 0 {
+		return &OptionError{"MaxTCPEntries", "must be positive"}
+	}
+	if o.RejectMethod != RejectWithTCPReset && o.RejectMethod != RejectWithICMPUnreachable {
+		return &OptionError{"RejectMethod", "unknown method"}
+	}
+	if o.Logger == nil {
+		return &OptionError{"Logger", "must not be nil"}
+	}
+	return nil
+}
+
+func validatePool(option string, pool, prefix netip.Prefix) error {
+	if pool.Bits() < prefix.Bits() || !prefix.Contains(pool.Addr()) {
+		return &OptionError{option, "not inside the prefix of the tun device"}
+	}
+	if _, ok := newNATPool(pool, prefix.Addr()); !ok {
+		return &OptionError{option, "no address left besides the tun device"}
+	}
+	return nil
+}
+
+// WithDevice use an existing device, such as device.Pipe
+func WithDevice(dev device.Device) Option {
+	return func(o *Options) {
+		o.Device = dev
+	}
+}
+
+// WithDevices use the existing queues of one device
+func WithDevices(devices ...device.Device) Option {
+	return func(o *Options) {
+		o.Devices = devices
+	}
+}
+
+// WithQueues number of queues of the device created with DeviceName
+func WithQueues(queues int) Option {
+	return func(o *Options) {
+		o.Queues = queues
+	}
+}
+
+// WithOffload open the device created with DeviceName with IFF_VNET_HDR
+func WithOffload(offload bool) Option {
+	return func(o *Options) {
+		o.Offload = offload
+	}
+}
+
+// WithDeviceName create a tun device with this name
+func WithDeviceName(name string) Option {
+	return func(o *Options) {
+		o.DeviceName = name
+	}
+}
+
+// WithUnixSocket receive the tun fd from a unix socket, basically for Android
+func WithUnixSocket(path string) Option {
+	return func(o *Options) {
+		o.UnixSocketPath = path
+	}
+}
+
+// WithIPv4Prefix ipv4 address of the tun device
+func WithIPv4Prefix(prefix netip.Prefix) Option {
+	return func(o *Options) {
+		o.IPv4Prefix = prefix
+	}
+}
+
+// WithIPv6Prefix ipv6 address of the tun device
+func WithIPv6Prefix(prefix netip.Prefix) Option {
+	return func(o *Options) {
+		o.IPv6Prefix = prefix
+	}
+}
+
+// WithFakeIPv4Pool fake source addresses of NAT'd ipv4 connections
+func WithFakeIPv4Pool(pool netip.Prefix) Option {
+	return func(o *Options) {
+		o.FakeIPv4Pool = pool
+	}
+}
+
+// WithFakeIPv6Pool fake source addresses of NAT'd ipv6 connections
+func WithFakeIPv6Pool(pool netip.Prefix) Option {
+	return func(o *Options) {
+		o.FakeIPv6Pool = pool
+	}
+}
+
+// WithMTU the largest packet read from the device
+func WithMTU(mtu int) Option {
+	return func(o *Options) {
+		o.MTU = mtu
+	}
+}
+
+// WithListenAddr address of the internal TCP listener
+func WithListenAddr(addr string) Option {
+	return func(o *Options) {
+		o.ListenAddr = addr
+	}
+}
+
+// WithListener use an existing TCP listener, such as one with SO_REUSEPORT or
+// from systemd socket activation
+func WithListener(listener net.Listener) Option {
+	return func(o *Options) {
+		o.Listener = listener
+	}
+}
+
+// WithUDPQueueSize number of UDP packets waiting for ReadFromUDPAddrPort
+func WithUDPQueueSize(size int) Option {
+	return func(o *Options) {
+		o.UDPQueueSize = size
+	}
+}
+
+// WithUDPDropPolicy which packet is dropped when a UDP queue is full
+func WithUDPDropPolicy(policy UDPDropPolicy) Option {
+	return func(o *Options) {
+		o.UDPDropPolicy = policy
+	}
+}
+
+// WithUDPSessionTimeout idle timeout of UDP sessions
+func WithUDPSessionTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.UDPSessionTimeout = timeout
+	}
+}
+
+// WithMaxUDPSessions capacity of the UDP session table
+func WithMaxUDPSessions(max int) Option {
+	return func(o *Options) {
+		o.MaxUDPSessions = max
+	}
+}
+
+// WithReassemblyTimeout drop incomplete fragmented packets after it
+func WithReassemblyTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.ReassemblyTimeout = timeout
+	}
+}
+
+// WithMaxReassemblyBytes memory bound of fragments waiting for reassembly
+func WithMaxReassemblyBytes(max int) Option {
+	return func(o *Options) {
+		o.MaxReassemblyBytes = max
+	}
+}
+
+// WithMaxReassemblyPackets number of fragmented packets waiting for
+// reassembly
+func WithMaxReassemblyPackets(max int) Option {
+	return func(o *Options) {
+		o.MaxReassemblyPackets = max
+	}
+}
+
+// WithVerifyChecksums drop packets with a bad checksum
+func WithVerifyChecksums(verify bool) Option {
+	return func(o *Options) {
+		o.VerifyChecksums = verify
+	}
+}
+
+// WithLogger report background errors
+func WithLogger(logger Logger) Option {
+	return func(o *Options) {
+		o.Logger = logger
+	}
+}
+
+// WithTCPTimeouts idle timeouts of tcp nat map entries
+func WithTCPTimeouts(timeouts TCPTimeouts) Option {
+	return func(o *Options) {
+		o.TCPTimeouts = timeouts
+	}
+}
+
+// WithMaxTCPEntries capacity of the tcp nat map of each ip family
+func WithMaxTCPEntries(max int) Option {
+	return func(o *Options) {
+		o.MaxTCPEntries = max
+	}
+}
+
+// WithRejectPolicy choose to reject or drop TCP packets that can not be NAT'd
+func WithRejectPolicy(policy RejectPolicy) Option {
+	return func(o *Options) {
+		o.RejectPolicy = policy
+	}
+}
+
+// WithRejectMethod how TCP packets are rejected
+func WithRejectMethod(method RejectMethod) Option {
+	return func(o *Options) {
+		o.RejectMethod = method
+	}
+}
+
+// WithAdmissionPolicy decide each new TCP flow
+func WithAdmissionPolicy(policy AdmissionPolicy) Option {
+	return func(o *Options) {
+		o.AdmissionPolicy = policy
+	}
+}
+
+// WithPassthroughDialer dial the original destination of passthrough flows
+func WithPassthroughDialer(dialer Dialer) Option {
+	return func(o *Options) {
+		o.PassthroughDialer = dialer
+	}
+}
+
+// WithConfigure set the device created with DeviceName up over rtnetlink
+func WithConfigure(configure bool) Option {
+	return func(o *Options) {
+		o.Configure = configure
+	}
+}
+
+// WithRoutes routed to the device by Configure
+func WithRoutes(routes ...netip.Prefix) Option {
+	return func(o *Options) {
+		o.Routes = routes
+	}
+}
+
+// WithAutoRoute route Routes or all addresses to the device in a dedicated
+// table, removed by Close
+func WithAutoRoute(autoRoute bool) Option {
+	return func(o *Options) {
+		o.AutoRoute = autoRoute
+	}
+}
+
+// WithAutoRouteTable routing table dedicated to AutoRoute
+func WithAutoRouteTable(table int) Option {
+	return func(o *Options) {
+		o.AutoRouteTable = table
+	}
+}
+
+// WithAutoRoutePriority priority of the ip rules of AutoRoute
+func WithAutoRoutePriority(priority int) Option {
+	return func(o *Options) {
+		o.AutoRoutePriority = priority
+	}
+}
+
+// WithAutoRouteMark fwmark of the sockets that bypass AutoRoute
+func WithAutoRouteMark(mark uint32) Option {
+	return func(o *Options) {
+		o.AutoRouteMark = mark
+	}
+}
+
+// WithExcludeRoutes destinations that bypass AutoRoute
+func WithExcludeRoutes(routes ...netip.Prefix) Option {
+	return func(o *Options) {
+		o.ExcludeRoutes = routes
+	}
+}
+
+// WithPreCommands bash commands executed before the device is opened
+func WithPreCommands(commands ...string) Option {
+	return func(o *Options) {
+		o.PreCommands = commands
+	}
+}
+
+// WithPostCommands bash commands executed after the device is configured
+func WithPostCommands(commands ...string) Option {
+	return func(o *Options) {
+		o.PostCommands = commands
+	}
+}
@@ -0,0 +1,316 @@
+package tunat
+
+import (
+	"bytes"
+	"container/list"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// DefaultReassemblyTimeout default time to wait for all fragments of a packet
+const DefaultReassemblyTimeout = 30 * time.Second
+
+// DefaultMaxReassemblyBytes default memory bound of fragments waiting for
+// reassembly
+const DefaultMaxReassemblyBytes = 4 << 20
+
+// DefaultMaxReassemblyPackets default number of fragmented packets waiting
+// for reassembly
+const DefaultMaxReassemblyPackets = 1024
+
+// fragmentBufferOverhead memory of a fragmentBuffer besides its slices,
+// charged to keep many tiny buffers under MaxReassemblyBytes
+const fragmentBufferOverhead = 256
+
+// sizeofFragmentRange memory of a fragmentRange
+const sizeofFragmentRange = 16
+
+type fragmentKey struct {
+	saddr    netip.Addr
+	daddr    netip.Addr
+	id       uint32
+	protocol uint8 // ipv4 only, ipv6 takes it from the first fragment
+}
+
+type fragmentRange struct {
+	start int
+	end   int
+}
+
+// fragmentBuffer fragments of one packet
+type fragmentBuffer struct {
+	key      fragmentKey
+	element  *list.Element // in reassembler.order
+	header   []byte        // ip header of the first fragment
+	protocol uint8
+	data     []byte
+	ranges   []fragmentRange
+	received int
+	total    int // -1 until the last fragment arrives
+	created  time.Time
+	charged  int // counted in reassembler.bytes
+}
+
+// size memory held by the buffer
+func (b *fragmentBuffer) size() int {
+	return fragmentBufferOverhead + cap(b.header) + cap(b.data) + cap(b.ranges)*sizeofFragmentRange
+}
+
+// reassembler protected by mutex, used by the device reader and gcLoop
+type reassembler struct {
+	mutex      sync.Mutex
+	buffers    map[fragmentKey]*fragmentBuffer
+	order      *list.List // of *fragmentBuffer, oldest first
+	bytes      int
+	maxBytes   int
+	maxPackets int
+	timeout    time.Duration
+}
+
+func newReassembler(maxBytes, maxPackets int, timeout time.Duration) *reassembler {
+	return &reassembler{
+		buffers:    make(map[fragmentKey]*fragmentBuffer),
+		order:      list.New(),
+		maxBytes:   maxBytes,
+		maxPackets: maxPackets,
+		timeout:    timeout,
+	}
+}
+
+// reassembleIPv4 returns the whole packet once its last missing fragment
+// arrives, packet is not retained
+func (t *Tunat) reassembleIPv4(packet header.IPv4) (header.IPv4, bool) {
+	saddr, _ := netip.AddrFromSlice([]byte(packet.SourceAddress()))
+	daddr, _ := netip.AddrFromSlice([]byte(packet.DestinationAddress()))
+	key := fragmentKey{
+		saddr:    saddr,
+		daddr:    daddr,
+		id:       uint32(packet.ID()),
+		protocol: packet.Protocol(),
+	}
+
+	buffer, ok := t.reassembler.add(t, key,
+		packet[:packet.HeaderLength()],
+		packet.Protocol(),
+		int(packet.FragmentOffset()),
+		packet.Payload(),
+		packet.More(),
+		0xffff-int(packet.HeaderLength()),
+		false,
+	)
+	if !ok {
+		return nil, false
+	}
+
+	whole := header.IPv4(append(buffer.header, buffer.data...))
+	whole.SetTotalLength(uint16(len(whole)))
+	whole.SetFlagsFragmentOffset(0, 0)
+	whole.SetChecksum(0)
+	whole.SetChecksum(^whole.CalculateChecksum())
+	return whole, true
+}
+
+// reassembleIPv6 like reassembleIPv4, the Fragment header is at offset, the
+// extension headers before it are kept from the first fragment
+func (t *Tunat) reassembleIPv6(packet header.IPv6, offset int) (header.IPv6, bool) {
+	end := header.IPv6MinimumSize + int(packet.PayloadLength())
+	if offset+header.IPv6FragmentHeaderSize > end {
+		atomic.AddUint64(&t.stats.DroppedFragments, 1)
+		return nil, false
+	}
+	fragment := header.IPv6Fragment(packet[offset:end])
+	saddr, _ := netip.AddrFromSlice([]byte(packet.SourceAddress()))
+	daddr, _ := netip.AddrFromSlice([]byte(packet.DestinationAddress()))
+	key := fragmentKey{saddr: saddr, daddr: daddr, id: fragment.ID()}
+
+	buffer, ok := t.reassembler.add(t, key,
+		packet[:offset],
+		fragment.NextHeader(),
+		int(fragment.FragmentOffset())*8,
+		fragment.Payload(),
+		fragment.More(),
+		0xffff-offset+header.IPv6MinimumSize,
+		true,
+	)
+	if !ok {
+		return nil, false
+	}
+
+	whole := header.IPv6(append(buffer.header, buffer.data...))
+	whole.SetPayloadLength(uint16(len(whole) - header.IPv6MinimumSize))
+	setIPv6NextHeader(whole, len(buffer.header), buffer.protocol)
+	return whole, true
+}
+
+// setIPv6NextHeader set the next header field of the last extension header
+// before offset, or of the fixed header
+func setIPv6NextHeader(packet header.IPv6, offset int, protocol uint8) {
+	field := header.IPv6NextHeaderOffset
+	for next := header.IPv6MinimumSize; next < offset; next += (int(packet[next+1]) + 1) * 8 {
+		field = next
+	}
+	packet[field] = protocol
+}
+
+// add ok once buffer is complete, it is removed from the reassembler then.
+// Every byte allocated for a buffer is charged against maxBytes, including
+// the gap before a fragment with a high offset
+func (r *reassembler) add(t *Tunat,
+	key fragmentKey,
+	ipHeader []byte,
+	protocol uint8,
+	offset int,
+	payload []byte,
+	more bool,
+	maxLen int,
+	ipv6 bool,
+) (buffer *fragmentBuffer, ok bool) {
+	end := offset + len(payload)
+	if end > maxLen || (more && (len(payload) == 0 || len(payload)%8 != 0)) {
+		atomic.AddUint64(&t.stats.DroppedFragments, 1)
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	buffer, exist := r.buffers[key]
+	if !exist {
+		if len(r.buffers) >= r.maxPackets {
+			r.evictOldest(t, nil)
+		}
+		buffer = &fragmentBuffer{key: key, total: -1, created: time.Now()}
+		buffer.element = r.order.PushBack(buffer)
+		r.buffers[key] = buffer
+		r.charge(buffer)
+	}
+	for _, received := range buffer.ranges {
+		if offset >= received.end || received.start >= end {
+			continue
+		}
+		// an ipv4 retransmission, ipv6 forbids overlapping fragments as
+		// RFC 5722
+		if !ipv6 && offset == received.start && end == received.end &&
+			bytes.Equal(buffer.data[offset:end], payload) {
+			return nil, false
+		}
+		r.remove(t, key, buffer)
+		return
+	}
+	if (!more && buffer.total >= 0) || (buffer.total >= 0 && end > buffer.total) {
+		r.remove(t, key, buffer)
+		return
+	}
+
+	// grow the slices by hand so that what is charged is what is allocated
+	dataCap, rangesCap, headerCap := cap(buffer.data), cap(buffer.ranges), cap(buffer.header)
+	if end > dataCap {
+		dataCap = 2 * dataCap
+		if dataCap < end {
+			dataCap = end
+		}
+		if dataCap > maxLen {
+			dataCap = maxLen
+		}
+	}
+	if len(buffer.ranges) == rangesCap {
+		rangesCap = 2*rangesCap + 1
+	}
+	if offset == 0 {
+		headerCap = len(ipHeader)
+	}
+	grow := dataCap - cap(buffer.data) +
+		(rangesCap-cap(buffer.ranges))*sizeofFragmentRange +
+		headerCap - cap(buffer.header)
+	for r.bytes+grow > r.maxBytes && r.evictOldest(t, buffer) {
+	}
+	if r.bytes+grow > r.maxBytes {
+		r.remove(t, key, buffer)
+		return
+	}
+
+	if dataCap != cap(buffer.data) {
+		data := make([]byte, len(buffer.data), dataCap)
+		copy(data, buffer.data)
+		buffer.data = data
+	}
+	if end > len(buffer.data) {
+		buffer.data = buffer.data[:end]
+	}
+	copy(buffer.data[offset:], payload)
+	if rangesCap != cap(buffer.ranges) {
+		ranges := make([]fragmentRange, len(buffer.ranges), rangesCap)
+		copy(ranges, buffer.ranges)
+		buffer.ranges = ranges
+	}
+	buffer.ranges = append(buffer.ranges, fragmentRange{offset, end})
+	buffer.received += len(payload)
+	if offset == 0 {
+		buffer.header = append(make([]byte, 0, headerCap), ipHeader...)
+		buffer.protocol = protocol
+	}
+	if !more {
+		buffer.total = end
+	}
+	r.charge(buffer)
+
+	if buffer.total < 0 || buffer.received != buffer.total || buffer.header == nil {
+		return nil, false
+	}
+	r.delete(buffer)
+	return buffer, true
+}
+
+// charge count the memory held by buffer
+func (r *reassembler) charge(buffer *fragmentBuffer) {
+	size := buffer.size()
+	r.bytes += size - buffer.charged
+	buffer.charged = size
+}
+
+func (r *reassembler) delete(buffer *fragmentBuffer) {
+	delete(r.buffers, buffer.key)
+	r.order.Remove(buffer.element)
+	r.bytes -= buffer.charged
+}
+
+// remove drop buffer along with the fragment being added
+func (r *reassembler) remove(t *Tunat, key fragmentKey, buffer *fragmentBuffer) {
+	r.delete(buffer)
+	atomic.AddUint64(&t.stats.DroppedFragments, uint64(len(buffer.ranges))+1)
+}
+
+// evictOldest make room for a fragment of keep
+func (r *reassembler) evictOldest(t *Tunat, keep *fragmentBuffer) bool {
+	element := r.order.Front()
+	if element != nil && element.Value.(*fragmentBuffer) == keep {
+		element = element.Next()
+	}
+	if element == nil {
+		return false
+	}
+	oldest := element.Value.(*fragmentBuffer)
+	r.delete(oldest)
+	atomic.AddUint64(&t.stats.DroppedFragments, uint64(len(oldest.ranges)))
+	return true
+}
+
+// gcFragments drop packets whose fragments did not all arrive in time
+func (t *Tunat) gcFragments(now time.Time) {
+	r := t.reassembler
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for element := r.order.Front(); element != nil; element = r.order.Front() {
+		buffer := element.Value.(*fragmentBuffer)
+		if now.Sub(buffer.created) <= r.timeout {
+			return
+		}
+		r.delete(buffer)
+		atomic.AddUint64(&t.stats.DroppedFragments, uint64(len(buffer.ranges)))
+	}
+}
@@ -0,0 +1,165 @@
+package tunat
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/FH0/tunat/device"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// buildFragments a UDP datagram fragmented at mtu
+func buildFragments(saddr, daddr netip.AddrPort, payload []byte, mtu int) [][]byte {
+	tn := &Tunat{file: &recordDevice{}, bufLen: mtu, buffers: newBufferPool(mtu)}
+	_, _ = tn.WriteToUDPAddrPort(payload, saddr, daddr)
+	return tn.file.(*recordDevice).packets
+}
+
+func TestReassembly(t *testing.T) {
+	tn, dev := newTunatWithOptions(t)
+	payload := make([]byte, 3000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		saddr netip.AddrPort
+		daddr netip.AddrPort
+	}{
+		{"ipv4", netip.MustParseAddrPort("10.0.0.1:1234"), netip.MustParseAddrPort("1.2.3.4:53")},
+		{"ipv6", netip.MustParseAddrPort("[fd::1]:1234"), netip.MustParseAddrPort("[2001:db8::1]:53")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fragments := buildFragments(tt.saddr, tt.daddr, payload, 1280)
+			if len(fragments) != 3 {
+				t.Fatalf("%d fragments", len(fragments))
+			}
+			// out of order
+			for i := len(fragments) - 1; i >= 0; i-- {
+				_, _ = dev.Write(fragments[i])
+			}
+
+			buf := make([]byte, 4000)
+			nread, saddr, daddr, err := tn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if saddr != tt.saddr || daddr != tt.daddr || !bytes.Equal(buf[:nread], payload) {
+				t.Fatalf("read %v -> %v %d bytes", saddr, daddr, nread)
+			}
+		})
+	}
+}
+
+// syncReassembly wait until the device reader handled every packet written
+// before
+func syncReassembly(t *testing.T, tn *Tunat, dev device.Device) {
+	t.Helper()
+
+	saddr := netip.MustParseAddrPort("10.0.0.1:1234")
+	daddr := netip.MustParseAddrPort("1.2.3.4:53")
+	_, _ = dev.Write(buildUDP(saddr, daddr, []byte("sync")))
+	buf := make([]byte, 100)
+	nread, _, _, err := tn.ReadFromUDPAddrPort(buf)
+	if err != nil || string(buf[:nread]) != "sync" {
+		t.Fatalf("read %q %v", buf[:nread], err)
+	}
+}
+
+// checkReassemblyBytes the charged bytes match the buffers and respect the
+// limits
+func checkReassemblyBytes(t *testing.T, r *reassembler) {
+	t.Helper()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var size int
+	for _, buffer := range r.buffers {
+		size += buffer.size()
+	}
+	if size != r.bytes || r.bytes > r.maxBytes || len(r.buffers) > r.maxPackets || r.order.Len() != len(r.buffers) {
+		t.Fatalf("%d bytes charged, %d held, %d buffers", r.bytes, size, len(r.buffers))
+	}
+}
+
+func TestReassemblyDrop(t *testing.T) {
+	v4Fragments := buildFragments(
+		netip.MustParseAddrPort("10.0.0.1:1234"), netip.MustParseAddrPort("1.2.3.4:53"), make([]byte, 3000), 1280)
+	v6Fragments := buildFragments(
+		netip.MustParseAddrPort("[fd::1]:1234"), netip.MustParseAddrPort("[2001:db8::1]:53"), make([]byte, 3000), 1280)
+
+	t.Run("timeout", func(t *testing.T) {
+		tn, dev := newTunatWithOptions(t)
+		_, _ = dev.Write(v4Fragments[0])
+		syncReassembly(t, tn, dev)
+		tn.gcFragments(time.Now().Add(DefaultReassemblyTimeout + time.Second))
+		if dropped := tn.Stats().DroppedFragments; dropped != 1 {
+			t.Fatalf("%d dropped after timeout", dropped)
+		}
+		checkReassemblyBytes(t, tn.reassembler)
+	})
+
+	t.Run("ipv4 retransmission", func(t *testing.T) {
+		tn, dev := newTunatWithOptions(t)
+		for _, i := range []int{0, 1, 1, 0, 2} {
+			_, _ = dev.Write(v4Fragments[i])
+		}
+		buf := make([]byte, 4000)
+		nread, _, _, err := tn.ReadFromUDPAddrPort(buf)
+		if err != nil || nread != 3000 {
+			t.Fatalf("read %d bytes %v", nread, err)
+		}
+		if dropped := tn.Stats().DroppedFragments; dropped != 0 {
+			t.Fatalf("%d dropped", dropped)
+		}
+	})
+
+	t.Run("ipv6 overlap", func(t *testing.T) {
+		tn, dev := newTunatWithOptions(t)
+		_, _ = dev.Write(v6Fragments[1])
+		_, _ = dev.Write(v6Fragments[1])
+		syncReassembly(t, tn, dev)
+		if dropped := tn.Stats().DroppedFragments; dropped != 2 {
+			t.Fatalf("%d dropped after overlap", dropped)
+		}
+		checkReassemblyBytes(t, tn.reassembler)
+	})
+
+	t.Run("memory limit", func(t *testing.T) {
+		tn, dev := newTunatWithOptions(t, WithMaxReassemblyBytes(2000))
+		_, _ = dev.Write(v4Fragments[0])
+		_, _ = dev.Write(v4Fragments[1])
+		syncReassembly(t, tn, dev)
+		if dropped := tn.Stats().DroppedFragments; dropped != 2 {
+			t.Fatalf("%d dropped beyond the memory limit", dropped)
+		}
+		if len(tn.reassembler.buffers) != 0 || tn.reassembler.bytes != 0 {
+			t.Fatal("leaked fragments")
+		}
+	})
+}
+
+// TestReassemblyFlood tiny fragments at a high offset allocate the gap before
+// them, which must be charged
+func TestReassemblyFlood(t *testing.T) {
+	tn, dev := newTunatWithOptions(t)
+	packet := header.IPv4(buildUDP(netip.MustParseAddrPort("10.0.0.1:1234"), netip.MustParseAddrPort("1.2.3.4:53"), nil))
+	packet = packet[:header.IPv4MinimumSize+8]
+	for id := 0; id < 5000; id++ {
+		packet.SetID(uint16(id))
+		packet.SetFlagsFragmentOffset(header.IPv4FlagMoreFragments, 64992)
+		packet.SetTotalLength(uint16(len(packet)))
+		packet.SetChecksum(0)
+		packet.SetChecksum(^packet.CalculateChecksum())
+		_, _ = dev.Write(packet)
+	}
+	syncReassembly(t, tn, dev)
+
+	checkReassemblyBytes(t, tn.reassembler)
+	if dropped := tn.Stats().DroppedFragments; dropped < 5000-DefaultMaxReassemblyBytes/64992 {
+		t.Fatalf("%d dropped", dropped)
+	}
+}
@@ -0,0 +1,178 @@
+package tunat
+
+import (
+	"net/netip"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// Action what to do with a TCP packet or a new TCP flow
+type Action int
+
+const (
+	// ActionDrop drop the packet silently
+	ActionDrop Action = iota
+	// ActionReject answer the packet with RejectMethod
+	ActionReject
+	// ActionAccept NAT the flow to the listener, returned by Accept
+	ActionAccept
+	// ActionPassthrough NAT the flow to the listener, then relay it to its
+	// original destination through Options.PassthroughDialer
+	ActionPassthrough
+)
+
+// RejectReason why a TCP packet can not be NAT'd
+type RejectReason int
+
+const (
+	// RejectNoFreeAddress no fake source address or nat map entry left for a SYN
+	RejectNoFreeAddress RejectReason = iota
+	// RejectNoEntry a packet other than SYN matches no nat map
+	RejectNoEntry
+)
+
+func (r RejectReason) String() string {
+	switch r {
+	case RejectNoFreeAddress:
+		return "no free address"
+	case RejectNoEntry:
+		return "no entry"
+	default:
+		return "unknown"
+	}
+}
+
+// RejectPolicy choose ActionDrop or ActionReject for a TCP packet that can not
+// be NAT'd, saddr and daddr are the addresses of the packet
+type RejectPolicy func(saddr, daddr netip.AddrPort, reason RejectReason) Action
+
+// RejectMethod how a TCP packet is rejected
+type RejectMethod int
+
+const (
+	// RejectWithTCPReset answer with a TCP RST
+	RejectWithTCPReset RejectMethod = iota
+	// RejectWithICMPUnreachable answer with an ICMP or ICMPv6 port unreachable
+	RejectWithICMPUnreachable
+)
+
+// rejectAction ActionReject or ActionDrop by RejectPolicy, a RST is never
+// answered
+func (t *Tunat) rejectAction(saddr, daddr netip.AddrPort, flags header.TCPFlags, reason RejectReason) Action {
+	if flags&header.TCPFlagRst != 0 {
+		return ActionDrop
+	}
+	if t.rejectPolicy == nil {
+		return ActionReject
+	}
+	return t.rejectPolicy(saddr, daddr, reason)
+}
+
+// rejectTCP packet is the whole ip packet
+func (t *Tunat) rejectTCP(packet []byte, tcpHeader header.TCP, saddr, daddr netip.AddrPort) {
+	if t.rejectMethod == RejectWithICMPUnreachable {
+		_, _ = t.file.Write(buildICMPUnreachable(packet, saddr.Addr(), daddr.Addr()))
+	} else {
+		_, _ = t.file.Write(buildTCPReset(tcpHeader, saddr, daddr))
+	}
+}
+
+// buildTCPReset RST from daddr to saddr as RFC 793 "Reset Generation"
+func buildTCPReset(tcpHeader header.TCP, saddr, daddr netip.AddrPort) []byte {
+	fields := header.TCPFields{
+		SrcPort:    daddr.Port(),
+		DstPort:    saddr.Port(),
+		DataOffset: header.TCPMinimumSize,
+		Flags:      header.TCPFlagRst,
+	}
+	if tcpHeader.Flags()&header.TCPFlagAck != 0 {
+		fields.SeqNum = tcpHeader.AckNumber()
+	} else {
+		segLen := uint32(len(tcpHeader.Payload()))
+		if tcpHeader.Flags()&header.TCPFlagSyn != 0 {
+			segLen++
+		}
+		if tcpHeader.Flags()&header.TCPFlagFin != 0 {
+			segLen++
+		}
+		fields.AckNum = tcpHeader.SequenceNumber() + segLen
+		fields.Flags |= header.TCPFlagAck
+	}
+
+	packet, payload := buildIPPacket(daddr.Addr(), saddr.Addr(), header.TCPProtocolNumber, header.TCPMinimumSize)
+	reset := header.TCP(payload)
+	reset.Encode(&fields)
+	reset.SetChecksum(^reset.CalculateChecksum(
+		header.PseudoHeaderChecksum(
+			header.TCPProtocolNumber,
+			tcpip.Address(daddr.Addr().AsSlice()),
+			tcpip.Address(saddr.Addr().AsSlice()),
+			header.TCPMinimumSize,
+		),
+	))
+	return packet
+}
+
+// buildICMPUnreachable port unreachable from daddr to saddr, quoting packet
+// as much as RFC 792 and RFC 4443 suggest
+func buildICMPUnreachable(packet []byte, saddr, daddr netip.Addr) []byte {
+	if saddr.Is4() {
+		quoteLen := int(header.IPv4(packet).HeaderLength()) + header.ICMPv4MinimumErrorPayloadSize
+		if quoteLen > len(packet) {
+			quoteLen = len(packet)
+		}
+		reply, payload := buildIPPacket(daddr, saddr, header.ICMPv4ProtocolNumber, header.ICMPv4MinimumSize+quoteLen)
+		icmpHeader := header.ICMPv4(payload)
+		icmpHeader.SetType(header.ICMPv4DstUnreachable)
+		icmpHeader.SetCode(header.ICMPv4PortUnreachable)
+		copy(icmpHeader.Payload(), packet[:quoteLen])
+		icmpHeader.SetChecksum(header.ICMPv4Checksum(icmpHeader, 0))
+		return reply
+	}
+
+	quoteLen := header.IPv6MinimumMTU - header.IPv6MinimumSize - header.ICMPv6DstUnreachableMinimumSize
+	if quoteLen > len(packet) {
+		quoteLen = len(packet)
+	}
+	reply, payload := buildIPPacket(daddr, saddr, header.ICMPv6ProtocolNumber, header.ICMPv6DstUnreachableMinimumSize+quoteLen)
+	icmpHeader := header.ICMPv6(payload)
+	icmpHeader.SetType(header.ICMPv6DstUnreachable)
+	icmpHeader.SetCode(header.ICMPv6PortUnreachable)
+	copy(icmpHeader.Payload(), packet[:quoteLen])
+	icmpHeader.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+		Header:      icmpHeader[:header.ICMPv6DstUnreachableMinimumSize],
+		Src:         tcpip.Address(daddr.AsSlice()),
+		Dst:         tcpip.Address(saddr.AsSlice()),
+		PayloadCsum: header.Checksum(icmpHeader.Payload(), 0),
+		PayloadLen:  len(icmpHeader.Payload()),
+	}))
+	return reply
+}
+
+// buildIPPacket a packet with the ip header filled, payload is the rest
+func buildIPPacket(saddr, daddr netip.Addr, protocol tcpip.TransportProtocolNumber, payloadLen int) (packet, payload []byte) {
+	if saddr.Is4() {
+		packet = make([]byte, header.IPv4MinimumSize+payloadLen)
+		ipHeader := header.IPv4(packet)
+		ipHeader.Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(packet)),
+			TTL:         64,
+			Protocol:    uint8(protocol),
+			SrcAddr:     tcpip.Address(saddr.AsSlice()),
+			DstAddr:     tcpip.Address(daddr.AsSlice()),
+		})
+		ipHeader.SetChecksum(^ipHeader.CalculateChecksum())
+		return packet, packet[header.IPv4MinimumSize:]
+	}
+
+	packet = make([]byte, header.IPv6MinimumSize+payloadLen)
+	header.IPv6(packet).Encode(&header.IPv6Fields{
+		PayloadLength:     uint16(payloadLen),
+		TransportProtocol: protocol,
+		HopLimit:          64,
+		SrcAddr:           tcpip.Address(saddr.AsSlice()),
+		DstAddr:           tcpip.Address(daddr.AsSlice()),
+	})
+	return packet, packet[header.IPv6MinimumSize:]
+}
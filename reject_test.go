@@ -0,0 +1,185 @@
+package tunat
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/FH0/tunat/device"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+func newTunatWithOptions(t testing.TB, options ...Option) (*Tunat, device.Device) {
+	t.Helper()
+
+	tunSide, testSide := device.Pipe()
+	tn, err := NewWithOptions(append([]Option{
+		WithDevice(tunSide),
+		WithIPv4Prefix(netip.MustParsePrefix("10.0.0.1/24")),
+		WithIPv6Prefix(netip.MustParsePrefix("fd::1/120")),
+	}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		tn.Close()
+	})
+	return tn, testSide
+}
+
+func TestRejectTCPReset(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		saddr netip.AddrPort
+		daddr netip.AddrPort
+	}{
+		{"ipv4", netip.MustParseAddrPort("10.0.0.1:1234"), netip.MustParseAddrPort("1.2.3.4:80")},
+		{"ipv6", netip.MustParseAddrPort("[fd::1]:1234"), netip.MustParseAddrPort("[2001:db8::1]:80")},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, dev := newTunatWithOptions(t)
+
+			// with ACK, the RST takes its sequence number from the ACK
+			packet := buildTCP(test.saddr, test.daddr, header.TCPFlagAck, []byte("hello"))
+			ackHeader := header.TCP(packet[len(packet)-header.TCPMinimumSize-5:])
+			ackHeader.SetAckNumber(4321)
+			ackHeader.SetChecksum(0)
+			ackHeader.SetChecksum(^ackHeader.CalculateChecksum(
+				header.Checksum(ackHeader.Payload(), header.PseudoHeaderChecksum(
+					header.TCPProtocolNumber,
+					tcpip.Address(test.saddr.Addr().AsSlice()),
+					tcpip.Address(test.daddr.Addr().AsSlice()),
+					uint16(len(ackHeader)),
+				)),
+			))
+			_, _ = dev.Write(packet)
+			saddr, daddr, tcpHeader := parseTCP(t, readPacket(t, dev))
+			if saddr != test.daddr || daddr != test.saddr {
+				t.Fatalf("reset %v -> %v", saddr, daddr)
+			}
+			if tcpHeader.Flags() != header.TCPFlagRst || tcpHeader.SequenceNumber() != 4321 {
+				t.Fatalf("flags %v seq %v", tcpHeader.Flags(), tcpHeader.SequenceNumber())
+			}
+
+			// without ACK, the RST acknowledges the whole segment
+			_, _ = dev.Write(buildTCP(test.saddr, test.daddr, header.TCPFlagFin, []byte("hello")))
+			_, _, tcpHeader = parseTCP(t, readPacket(t, dev))
+			if tcpHeader.Flags() != header.TCPFlagRst|header.TCPFlagAck || tcpHeader.AckNumber() != 1000+5+1 {
+				t.Fatalf("flags %v ack %v", tcpHeader.Flags(), tcpHeader.AckNumber())
+			}
+		})
+	}
+}
+
+func TestRejectICMP(t *testing.T) {
+	_, dev := newTunatWithOptions(t, WithRejectMethod(RejectWithICMPUnreachable))
+	saddr := netip.MustParseAddrPort("10.0.0.1:1234")
+	daddr := netip.MustParseAddrPort("1.2.3.4:80")
+
+	packet := buildTCP(saddr, daddr, header.TCPFlagAck, nil)
+	_, _ = dev.Write(packet)
+	reply := header.IPv4(readPacket(t, dev))
+	if !reply.IsChecksumValid() || reply.TransportProtocol() != header.ICMPv4ProtocolNumber {
+		t.Fatal("not an icmp packet")
+	}
+	if reply.SourceAddress() != tcpip.Address(daddr.Addr().AsSlice()) || reply.DestinationAddress() != tcpip.Address(saddr.Addr().AsSlice()) {
+		t.Fatalf("icmp %v -> %v", reply.SourceAddress(), reply.DestinationAddress())
+	}
+	icmpHeader := header.ICMPv4(reply.Payload())
+	if icmpHeader.Type() != header.ICMPv4DstUnreachable || icmpHeader.Code() != header.ICMPv4PortUnreachable {
+		t.Fatalf("type %v code %v", icmpHeader.Type(), icmpHeader.Code())
+	}
+	if header.Checksum(icmpHeader, 0) != 0xffff {
+		t.Fatal("bad icmp checksum")
+	}
+	if string(icmpHeader.Payload()) != string(packet[:header.IPv4MinimumSize+8]) {
+		t.Fatal("bad quote")
+	}
+
+	saddr = netip.MustParseAddrPort("[fd::1]:1234")
+	daddr = netip.MustParseAddrPort("[2001:db8::1]:80")
+	packet = buildTCP(saddr, daddr, header.TCPFlagAck, nil)
+	_, _ = dev.Write(packet)
+	reply6 := header.IPv6(readPacket(t, dev))
+	icmpv6Header := header.ICMPv6(reply6.Payload())
+	if reply6.TransportProtocol() != header.ICMPv6ProtocolNumber ||
+		icmpv6Header.Type() != header.ICMPv6DstUnreachable ||
+		icmpv6Header.Code() != header.ICMPv6PortUnreachable {
+		t.Fatal("not an icmpv6 port unreachable")
+	}
+	if header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+		Header:      icmpv6Header[:header.ICMPv6DstUnreachableMinimumSize],
+		Src:         reply6.SourceAddress(),
+		Dst:         reply6.DestinationAddress(),
+		PayloadCsum: header.Checksum(icmpv6Header.Payload(), 0),
+		PayloadLen:  len(icmpv6Header.Payload()),
+	}) != icmpv6Header.Checksum() {
+		t.Fatal("bad icmpv6 checksum")
+	}
+	if string(icmpv6Header.Payload()) != string(packet) {
+		t.Fatal("bad quote")
+	}
+}
+
+func TestRejectPolicy(t *testing.T) {
+	var reasons []RejectReason
+	_, dev := newTunatWithOptions(t, WithRejectPolicy(func(saddr, daddr netip.AddrPort, reason RejectReason) Action {
+		reasons = append(reasons, reason)
+		if daddr.Port() == 80 {
+			return ActionDrop
+		}
+		return ActionReject
+	}))
+	saddr := netip.MustParseAddrPort("10.0.0.1:1234")
+
+	_, _ = dev.Write(buildTCP(saddr, netip.MustParseAddrPort("1.2.3.4:80"), header.TCPFlagAck, nil))
+	_, _ = dev.Write(buildTCP(saddr, netip.MustParseAddrPort("1.2.3.4:80"), header.TCPFlagRst, nil))
+	_, _ = dev.Write(buildTCP(saddr, netip.MustParseAddrPort("1.2.3.4:443"), header.TCPFlagAck, nil))
+	resetSaddr, resetDaddr, _ := parseTCP(t, readPacket(t, dev))
+	if resetSaddr.Port() != 443 || resetDaddr != saddr {
+		t.Fatalf("reset %v -> %v", resetSaddr, resetDaddr)
+	}
+	if len(reasons) != 2 || reasons[0] != RejectNoEntry || reasons[1] != RejectNoEntry {
+		t.Fatalf("reasons %v", reasons)
+	}
+}
+
+func TestRejectNoFreeAddress(t *testing.T) {
+	var reasons []RejectReason
+	tn, dev := newTunatWithOptions(t,
+		WithFakeIPv4Pool(netip.MustParsePrefix("10.0.0.2/32")),
+		WithRejectPolicy(func(saddr, daddr netip.AddrPort, reason RejectReason) Action {
+			reasons = append(reasons, reason)
+			return ActionReject
+		}),
+	)
+	daddr := netip.MustParseAddrPort("1.2.3.4:80")
+
+	// SYNs of one shard until its slots are used up by live connections
+	var saddrs []netip.AddrPort
+	shard := tn.ipv4NAT.sourceShard(netip.MustParseAddrPort("10.0.0.5:1"))
+	for port := 1; port < 65536; port++ {
+		saddr := netip.AddrPortFrom(netip.MustParseAddr("10.0.0.5"), uint16(port))
+		if tn.ipv4NAT.sourceShard(saddr) != shard {
+			continue
+		}
+		_, _ = dev.Write(buildTCP(saddr, daddr, header.TCPFlagSyn, nil))
+		_, resetDaddr, tcpHeader := parseTCP(t, readPacket(t, dev))
+		if tcpHeader.Flags()&header.TCPFlagRst != 0 {
+			if resetDaddr != saddr {
+				t.Fatalf("reset to %v", resetDaddr)
+			}
+			break
+		}
+		saddrs = append(saddrs, saddr)
+	}
+	if len(saddrs) == 0 || len(reasons) != 1 || reasons[0] != RejectNoFreeAddress {
+		t.Fatalf("%v connections, reasons %v", len(saddrs), reasons)
+	}
+
+	// the first connection still has its fake address
+	_, _ = dev.Write(buildTCP(saddrs[0], daddr, header.TCPFlagAck, nil))
+	if _, _, tcpHeader := parseTCP(t, readPacket(t, dev)); tcpHeader.Flags()&header.TCPFlagRst != 0 {
+		t.Fatal("live connection evicted")
+	}
+}
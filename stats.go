@@ -0,0 +1,46 @@
+package tunat
+
+import "sync/atomic"
+
+// Stats counters of a Tunat
+type Stats struct {
+	// UnknownTCPPeers connections to the listener that match no nat map,
+	// closed as soon as they are accepted
+	UnknownTCPPeers uint64
+	// DroppedUDPSessions new UDP flows dropped because the session table or
+	// the AcceptUDP queue is full
+	DroppedUDPSessions uint64
+	// DroppedUDPPackets UDP packets dropped because a queue is full, see
+	// UDPDropPolicy
+	DroppedUDPPackets uint64
+	// DroppedFragments IP fragments dropped because they are malformed,
+	// overlap, time out or exceed MaxReassemblyBytes or MaxReassemblyPackets
+	DroppedFragments uint64
+	// DroppedShortHeader packets shorter than their IP or transport header
+	DroppedShortHeader uint64
+	// DroppedBadHeaderLength packets whose IPv4 IHL or TCP data offset is out
+	// of range
+	DroppedBadHeaderLength uint64
+	// DroppedBadLength packets whose IP or UDP length field is out of range,
+	// or whose IPv6 extension headers overrun the packet
+	DroppedBadLength uint64
+	// DroppedBadChecksum packets with a bad checksum, see VerifyChecksums
+	DroppedBadChecksum uint64
+	// UDPQueueLen UDP packets waiting for ReadFromUDPAddrPort
+	UDPQueueLen int
+}
+
+// Stats a snapshot of the counters
+func (t *Tunat) Stats() Stats {
+	return Stats{
+		UnknownTCPPeers:        atomic.LoadUint64(&t.stats.UnknownTCPPeers),
+		DroppedUDPSessions:     atomic.LoadUint64(&t.stats.DroppedUDPSessions),
+		DroppedUDPPackets:      atomic.LoadUint64(&t.stats.DroppedUDPPackets),
+		DroppedFragments:       atomic.LoadUint64(&t.stats.DroppedFragments),
+		DroppedShortHeader:     atomic.LoadUint64(&t.stats.DroppedShortHeader),
+		DroppedBadHeaderLength: atomic.LoadUint64(&t.stats.DroppedBadHeaderLength),
+		DroppedBadLength:       atomic.LoadUint64(&t.stats.DroppedBadLength),
+		DroppedBadChecksum:     atomic.LoadUint64(&t.stats.DroppedBadChecksum),
+		UDPQueueLen:            len(t.udpChan),
+	}
+}
@@ -1,19 +1,18 @@
 package tunat
 
 import (
+	"context"
 	"errors"
 	"net"
 	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"gvisor.dev/gvisor/pkg/tcpip"
+	"github.com/FH0/tunat/device"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 )
 
-type tcpMapValue struct {
-	natAddr netip.AddrPort // fakeSAddr or originSAddr
-	daddr   netip.AddrPort
-}
-
 type tcpConn struct {
 	net.Conn
 	tunat          *Tunat
@@ -23,13 +22,9 @@ type tcpConn struct {
 	daddrInterface net.Addr
 }
 
-// Close delete nat map at the same time
+// Close the nat map is kept until conntrack sees the connection finished,
+// so that FIN and RST still reach the original source
 func (tc *tcpConn) Close() error {
-	if value, ok := tc.tunat.tcpMap.Load(tc.saddr); ok {
-		tc.tunat.tcpMap.Delete(value.(*tcpMapValue).natAddr)
-		tc.tunat.tcpMap.Delete(tc.saddr)
-	}
-
 	return tc.Conn.Close()
 }
 
@@ -43,23 +38,127 @@ func (tc *tcpConn) RemoteAddr() net.Addr {
 	return tc.saddrInterface
 }
 
+type tcpListener struct {
+	tunat     *Tunat
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// TCPListener net.Listener over Accept, such as for http.Serve, closing it
+// stops its Accept without closing Tunat
+func (t *Tunat) TCPListener() net.Listener {
+	return &tcpListener{
+		tunat:  t,
+		closed: make(chan struct{}),
+	}
+}
+
+// Accept like Tunat.Accept
+func (l *tcpListener) Accept() (net.Conn, error) {
+	return l.tunat.accept(context.Background(), l.closed)
+}
+
+// Close only this listener
+func (l *tcpListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+// Addr the address SYNs are redirected to
+func (l *tcpListener) Addr() net.Addr {
+	if l.tunat.ipv4TCPListenerAddrPort.IsValid() {
+		return net.TCPAddrFromAddrPort(l.tunat.ipv4TCPListenerAddrPort)
+	}
+	return net.TCPAddrFromAddrPort(l.tunat.ipv6TCPListenerAddrPort)
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
 // Accept like net package
 func (t *Tunat) Accept() (conn net.Conn, err error) {
-	acceptConn, err := t.tcpListener.Accept()
-	if err != nil {
-		return
+	return t.AcceptContext(context.Background())
+}
+
+// AcceptContext like Accept, but returns ctx.Err() once ctx is done
+func (t *Tunat) AcceptContext(ctx context.Context) (conn net.Conn, err error) {
+	return t.accept(ctx, nil)
+}
+
+// accept returns net.ErrClosed once stop is closed
+func (t *Tunat) accept(ctx context.Context, stop <-chan struct{}) (conn net.Conn, err error) {
+	t.startAcceptLoop()
+
+	var result acceptResult
+	select {
+	case result = <-t.acceptChan:
+	case <-t.closed:
+		return nil, net.ErrClosed
+	case <-stop:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
+	return result.conn, result.err
+}
+
+// startAcceptLoop the loops start with the first Accept or passthrough flow
+func (t *Tunat) startAcceptLoop() {
+	t.acceptOnce.Do(func() {
+		for _, listener := range t.tcpListeners {
+			go t.acceptLoop(listener)
+		}
+	})
+}
 
-	connRemoteAddr := acceptConn.RemoteAddr().(*net.TCPAddr).AddrPort()
-	if connRemoteAddr.Addr().Is4In6() {
-		connRemoteAddr = netip.AddrPortFrom(connRemoteAddr.Addr().Unmap(), connRemoteAddr.Port())
+// acceptLoop relay passthrough flows, close unknown peers and hand the
+// others to Accept, so that AcceptContext can give up waiting without losing
+// a connection
+func (t *Tunat) acceptLoop(listener net.Listener) {
+	for {
+		var result acceptResult
+		acceptConn, err := listener.Accept()
+		if err != nil {
+			result.err = err
+		} else {
+			conn, passthrough, ok := t.newTCPConn(acceptConn)
+			switch {
+			case !ok:
+				acceptConn.Close()
+				atomic.AddUint64(&t.stats.UnknownTCPPeers, 1)
+				continue
+			case passthrough:
+				go t.passthrough(conn)
+				continue
+			default:
+				result.conn = conn
+			}
+		}
+
+		select {
+		case t.acceptChan <- result:
+		case <-t.closed:
+			if result.conn != nil {
+				result.conn.Close()
+			}
+			return
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 	}
-	value, ok := t.tcpMap.Load(connRemoteAddr)
+}
+
+// newTCPConn ok if acceptConn is a NAT'd connection
+func (t *Tunat) newTCPConn(acceptConn net.Conn) (conn *tcpConn, passthrough, ok bool) {
+	saddr, daddr, passthrough, ok := t.lookupTCP(acceptConn.RemoteAddr().(*net.TCPAddr).AddrPort())
 	if !ok {
-		return nil, errors.New("tcp nat map not exist")
+		return
 	}
-	saddr := value.(*tcpMapValue).natAddr
-	daddr := value.(*tcpMapValue).daddr
 	conn = &tcpConn{
 		Conn:           acceptConn,
 		tunat:          t,
@@ -71,7 +170,7 @@ func (t *Tunat) Accept() (conn net.Conn, err error) {
 	return
 }
 
-func (t *Tunat) handleIPv4TCP(ipHeader header.IPv4, tcpHeader header.TCP) {
+func (t *Tunat) handleIPv4TCP(ipHeader header.IPv4, tcpHeader header.TCP, hdr *device.VirtioNetHdr) {
 	/*
 		tcpListener	10.0.0.1:100
 		raw			10.0.0.1:1234	->	1.2.3.4:4321	SYN
@@ -92,61 +191,19 @@ func (t *Tunat) handleIPv4TCP(ipHeader header.IPv4, tcpHeader header.TCP) {
 	}
 	daddr := netip.AddrPortFrom(ip, tcpHeader.DestinationPort())
 
-	if tcpHeader.Flags()&header.TCPFlagSyn == 0 || tcpHeader.Flags()&header.TCPFlagAck != 0 {
-		goto next
-	}
-	if _, ok := t.tcpMap.Load(saddr); ok {
-		goto next
-	}
-	for port, endPort := tcpHeader.SourcePort(), tcpHeader.SourcePort()-1; port != endPort; port++ {
-		if port == 0 {
-			continue
-		}
-		fakeAddr := netip.AddrPortFrom(t.fakeIPv4Addr, port)
-		if _, ok := t.tcpMap.Load(fakeAddr); !ok {
-			t.tcpMap.Store(fakeAddr, &tcpMapValue{natAddr: saddr, daddr: daddr})
-			t.tcpMap.Store(saddr, &tcpMapValue{natAddr: fakeAddr, daddr: daddr})
-			goto next
-		}
-	}
-	return
-
-next:
-	if value, ok := t.tcpMap.Load(saddr); ok {
-		ipHeader.SetSourceAddress(tcpip.Address(value.(*tcpMapValue).natAddr.Addr().AsSlice()))
-		ipHeader.SetDestinationAddress(tcpip.Address(t.ipv4TCPListenerAddrPort.Addr().AsSlice()))
-		tcpHeader.SetSourcePort(uint16(value.(*tcpMapValue).natAddr.Port()))
-		tcpHeader.SetDestinationPort(uint16(t.ipv4TCPListenerAddrPort.Port()))
-	} else if value, ok := t.tcpMap.Load(daddr); ok {
-		ipHeader.SetSourceAddress(tcpip.Address(value.(*tcpMapValue).daddr.Addr().AsSlice()))
-		ipHeader.SetDestinationAddress(tcpip.Address(value.(*tcpMapValue).natAddr.Addr().AsSlice()))
-		tcpHeader.SetSourcePort(uint16(value.(*tcpMapValue).daddr.Port()))
-		tcpHeader.SetDestinationPort(uint16(value.(*tcpMapValue).natAddr.Port()))
-	} else {
+	natSaddr, natDaddr, action := t.natTCP(saddr, daddr, tcpHeader.Flags(), t.ipv4NAT, t.ipv4TCPListenerAddrPort)
+	switch action {
+	case ActionDrop:
+		return
+	case ActionReject:
+		t.rejectTCP(ipHeader, tcpHeader, saddr, daddr)
 		return
 	}
-
-	ipHeader.SetChecksum(0)
-	ipHeader.SetChecksum(^ipHeader.CalculateChecksum())
-	tcpHeader.SetChecksum(0)
-	tcpHeader.SetChecksum(
-		^tcpHeader.CalculateChecksum(
-			header.Checksum(
-				tcpHeader.Payload(),
-				header.PseudoHeaderChecksum(
-					header.TCPProtocolNumber,
-					ipHeader.SourceAddress(),
-					ipHeader.DestinationAddress(),
-					uint16(len(tcpHeader)),
-				),
-			),
-		),
-	)
-
-	_, _ = t.file.Write(ipHeader)
+	rewriteIPv4TCP(ipHeader, tcpHeader, natSaddr, natDaddr, isPartial(hdr))
+	t.writeTCP(ipHeader, hdr)
 }
 
-func (t *Tunat) handleIPv6TCP(ipHeader header.IPv6, tcpHeader header.TCP) {
+func (t *Tunat) handleIPv6TCP(ipHeader header.IPv6, tcpHeader header.TCP, hdr *device.VirtioNetHdr) {
 	ip, ok := netip.AddrFromSlice([]byte(ipHeader.SourceAddress()))
 	if !ok {
 		return
@@ -158,54 +215,80 @@ func (t *Tunat) handleIPv6TCP(ipHeader header.IPv6, tcpHeader header.TCP) {
 	}
 	daddr := netip.AddrPortFrom(ip, tcpHeader.DestinationPort())
 
-	if tcpHeader.Flags()&header.TCPFlagSyn == 0 || tcpHeader.Flags()&header.TCPFlagAck != 0 {
-		goto next
+	natSaddr, natDaddr, action := t.natTCP(saddr, daddr, tcpHeader.Flags(), t.ipv6NAT, t.ipv6TCPListenerAddrPort)
+	switch action {
+	case ActionDrop:
+		return
+	case ActionReject:
+		t.rejectTCP(ipHeader, tcpHeader, saddr, daddr)
+		return
+	}
+	rewriteIPv6TCP(ipHeader, tcpHeader, natSaddr, natDaddr, isPartial(hdr))
+	t.writeTCP(ipHeader, hdr)
+}
+
+// natTCP look up or create the nat map of a packet and follow its state,
+// returns the rewritten addresses unless the packet is dropped or rejected
+func (t *Tunat) natTCP(saddr, daddr netip.AddrPort,
+	flags header.TCPFlags,
+	table *natTable,
+	listenerAddr netip.AddrPort,
+) (natSaddr, natDaddr netip.AddrPort, action Action) {
+	if table == nil {
+		return saddr, daddr, t.rejectAction(saddr, daddr, flags, RejectNoEntry)
 	}
-	if _, ok := t.tcpMap.Load(saddr); ok {
-		goto next
+	now := time.Now()
+
+	if fakeAddr, ok := table.lookupSource(saddr, flags, now); ok {
+		return fakeAddr, listenerAddr, ActionAccept
 	}
-	for port, endPort := tcpHeader.SourcePort(), tcpHeader.SourcePort()-1; port != endPort; port++ {
-		if port == 0 {
-			continue
+	if saddr == listenerAddr {
+		if saddr, daddr, ok := table.lookupFake(daddr, flags, now); ok {
+			return daddr, saddr, ActionAccept
 		}
-		fakeAddr := netip.AddrPortFrom(t.fakeIPv6Addr, port)
-		if _, ok := t.tcpMap.Load(fakeAddr); !ok {
-			t.tcpMap.Store(fakeAddr, &tcpMapValue{natAddr: saddr, daddr: daddr})
-			t.tcpMap.Store(saddr, &tcpMapValue{natAddr: fakeAddr, daddr: daddr})
-			goto next
+		return saddr, daddr, t.rejectAction(saddr, daddr, flags, RejectNoEntry)
+	}
+	if !isNewSyn(flags) {
+		return saddr, daddr, t.rejectAction(saddr, daddr, flags, RejectNoEntry)
+	}
+
+	action = ActionAccept
+	if t.admissionPolicy != nil {
+		action = t.admissionPolicy(Flow{Source: saddr, Destination: daddr, Interface: t.deviceName})
+		switch action {
+		case ActionAccept, ActionPassthrough:
+		case ActionReject:
+			return saddr, daddr, action
+		default:
+			return saddr, daddr, ActionDrop
 		}
 	}
+	fakeAddr, ok := table.insert(saddr, daddr, action == ActionPassthrough, now, &t.tcpTimeouts)
+	if !ok {
+		return saddr, daddr, t.rejectAction(saddr, daddr, flags, RejectNoFreeAddress)
+	}
+	if action == ActionPassthrough {
+		t.startAcceptLoop()
+	}
+	return fakeAddr, listenerAddr, action
+}
+
+// Lookup original source and destination of a connection accepted from the
+// listener, remote is its remote address
+func (t *Tunat) Lookup(remote netip.AddrPort) (src, dst netip.AddrPort, ok bool) {
+	src, dst, _, ok = t.lookupTCP(remote)
 	return
+}
 
-next:
-	if value, ok := t.tcpMap.Load(saddr); ok {
-		ipHeader.SetSourceAddress(tcpip.Address(value.(*tcpMapValue).natAddr.Addr().AsSlice()))
-		ipHeader.SetDestinationAddress(tcpip.Address(t.ipv6TCPListenerAddrPort.Addr().AsSlice()))
-		tcpHeader.SetSourcePort(uint16(value.(*tcpMapValue).natAddr.Port()))
-		tcpHeader.SetDestinationPort(uint16(t.ipv6TCPListenerAddrPort.Port()))
-	} else if value, ok := t.tcpMap.Load(daddr); ok {
-		ipHeader.SetSourceAddress(tcpip.Address(value.(*tcpMapValue).daddr.Addr().AsSlice()))
-		ipHeader.SetDestinationAddress(tcpip.Address(value.(*tcpMapValue).natAddr.Addr().AsSlice()))
-		tcpHeader.SetSourcePort(uint16(value.(*tcpMapValue).daddr.Port()))
-		tcpHeader.SetDestinationPort(uint16(value.(*tcpMapValue).natAddr.Port()))
-	} else {
-		return
+// lookupTCP original source and destination of a fake address
+func (t *Tunat) lookupTCP(fakeAddr netip.AddrPort) (saddr, daddr netip.AddrPort, passthrough, ok bool) {
+	if fakeAddr.Addr().Is4In6() {
+		fakeAddr = netip.AddrPortFrom(fakeAddr.Addr().Unmap(), fakeAddr.Port())
 	}
-
-	tcpHeader.SetChecksum(0)
-	tcpHeader.SetChecksum(
-		^tcpHeader.CalculateChecksum(
-			header.Checksum(
-				tcpHeader.Payload(),
-				header.PseudoHeaderChecksum(
-					header.TCPProtocolNumber,
-					ipHeader.SourceAddress(),
-					ipHeader.DestinationAddress(),
-					uint16(len(tcpHeader)),
-				),
-			),
-		),
-	)
-
-	_, _ = t.file.Write(ipHeader)
+	if fakeAddr.Addr().Is4() && t.ipv4NAT != nil {
+		return t.ipv4NAT.get(fakeAddr)
+	} else if fakeAddr.Addr().Is6() && t.ipv6NAT != nil {
+		return t.ipv6NAT.get(fakeAddr)
+	}
+	return
 }
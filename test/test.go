@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"net/netip"
@@ -51,6 +52,9 @@ func testUDP() {
 	go func() {
 		for {
 			nread, saddr, daddr, err := tn.ReadFromUDPAddrPort(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			if err != nil {
 				panic(err)
 			}
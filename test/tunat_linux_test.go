@@ -9,6 +9,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/FH0/tunat"
 	"github.com/FH0/tunat/device"
 )
 
@@ -76,3 +77,49 @@ func TestUnixSocket(t *testing.T) {
 	}
 	fmt.Println(hex.EncodeToString(buf[:nread]))
 }
+
+func TestConfigure(t *testing.T) {
+	tun2, err := tunat.NewWithOptions(
+		tunat.WithDeviceName("tun2"),
+		tunat.WithIPv4Prefix(netip.MustParsePrefix("10.0.2.1/24")),
+		tunat.WithIPv6Prefix(netip.MustParsePrefix("fd:2::1/120")),
+		tunat.WithMTU(1400),
+		tunat.WithConfigure(true),
+	)
+	if err != nil {
+		panic(err)
+	}
+	defer tun2.Close()
+
+	iface, err := net.InterfaceByName("tun2")
+	if err != nil {
+		panic(err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		panic(err)
+	}
+	if iface.MTU != 1400 || iface.Flags&net.FlagUp == 0 || len(addrs) < 2 {
+		t.Fatalf("interface %+v, addresses %v", iface, addrs)
+	}
+
+	// the prefix routes lead to the device
+	buf := make([]byte, 65535)
+	tun2.SetReadDeadline(time.Now().Add(time.Second))
+	for _, daddr := range []string{"10.0.2.3:100", "[fd:2::3]:100"} {
+		conn, err := net.Dial("udp", daddr)
+		if err != nil {
+			panic(err)
+		}
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("abcd"))
+		if err != nil {
+			panic(err)
+		}
+		nread, _, readDaddr, err := tun2.ReadFromUDPAddrPort(buf)
+		if err != nil || string(buf[:nread]) != "abcd" || readDaddr.String() != daddr {
+			t.Fatalf("read %q %v %v", buf[:nread], readDaddr, err)
+		}
+	}
+}
@@ -1,29 +1,58 @@
 package tunat
 
 import (
-	"errors"
 	"fmt"
-	"io"
 	"net"
 	"net/netip"
 	"os/exec"
 	"sync"
+	"sync/atomic"
 
 	"github.com/FH0/tunat/device"
+	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 )
 
 // Tunat main struct
 type Tunat struct {
-	file                    io.ReadWriteCloser
-	tcpListener             net.Listener
+	stats                   Stats         // first for 64-bit atomic alignment
+	file                    device.Device // first queue, packets are written to it
+	queues                  []device.Device
+	offload                 device.OffloadDevice // first queue, if it is one
+	tcpListeners            []net.Listener
 	ipv4TCPListenerAddrPort netip.AddrPort
 	ipv6TCPListenerAddrPort netip.AddrPort
-	fakeIPv4Addr            netip.Addr
-	fakeIPv6Addr            netip.Addr
+	ipv4NAT                 *natTable
+	ipv6NAT                 *natTable
 	udpChan                 chan udpData
+	udpSessions             *udpSessionTable
+	udpDropPolicy           UDPDropPolicy
 	bufLen                  int
-	tcpMap                  sync.Map
+	buffers                 *bufferPool
+	fragmentID              uint32
+	verifyChecksums         bool
+	reassembler             *reassembler
+	tcpTimeouts             TCPTimeouts
+	rejectPolicy            RejectPolicy
+	rejectMethod            RejectMethod
+	admissionPolicy         AdmissionPolicy
+	dialer                  Dialer
+	deviceName              string
+	prefixes                []netip.Prefix
+	autoRouteMark           uint32
+	outbound                *OutboundDialer
+	logger                  Logger
+	acceptChan              chan acceptResult
+	acceptOnce              sync.Once
+	readDeadline            deadline
+	writeDeadline           deadline
+	unconfigure             func() error // removes AutoRoute
+
+	closed    chan struct{} // closed as soon as Close starts
+	done      chan struct{} // closed after everything is torn down
+	closeOnce sync.Once
+	closeErr  error
+	err       error
 }
 
 // New new a Tunat
@@ -34,86 +63,365 @@ func New(name string,
 	preCommands []string,
 	postCommands []string,
 ) (tunat *Tunat, err error) {
-	tunat = &Tunat{
-		udpChan: make(chan udpData, 100),
-		bufLen:  bufLen,
-	}
+	return NewWithOptions(
+		WithDeviceName(name),
+		WithIPv4Prefix(ipv4Prefix),
+		WithIPv6Prefix(ipv6Prefix),
+		WithMTU(bufLen),
+		WithPreCommands(preCommands...),
+		WithPostCommands(postCommands...),
+	)
+}
 
-	err = excuteCommands(preCommands)
+// NewFromDevice new a Tunat on any device, such as device.Pipe
+func NewFromDevice(file device.Device,
+	ipv4Prefix,
+	ipv6Prefix netip.Prefix,
+	bufLen int,
+) (tunat *Tunat, err error) {
+	return NewWithOptions(
+		WithDevice(file),
+		WithIPv4Prefix(ipv4Prefix),
+		WithIPv6Prefix(ipv6Prefix),
+		WithMTU(bufLen),
+	)
+}
+
+// NewWithOptions new a Tunat, options are validated before anything is opened
+func NewWithOptions(options ...Option) (tunat *Tunat, err error) {
+	opts := defaultOptions()
+	for _, option := range options {
+		option(&opts)
+	}
+	err = opts.validate()
 	if err != nil {
 		return
 	}
-	tunat.file, err = device.New(name)
+
+	err = excuteCommands(opts.PreCommands)
 	if err != nil {
 		return
 	}
-	err = excuteCommands(postCommands)
+	queues, err := openDevice(&opts)
 	if err != nil {
 		return
 	}
-	tunat.tcpListener, err = net.Listen("tcp", "[::]:0")
+	defer func() {
+		if err != nil && opts.Device == nil && len(opts.Devices) == 0 {
+			for _, queue := range queues {
+				queue.Close()
+			}
+		}
+	}()
+	unconfigure, err := configureDevice(&opts)
 	if err != nil {
 		return
 	}
-	if ipv4Prefix.IsValid() {
-		tunat.ipv4TCPListenerAddrPort = netip.AddrPortFrom(
-			ipv4Prefix.Addr(),
-			uint16(tunat.tcpListener.Addr().(*net.TCPAddr).Port),
-		)
-		tunat.fakeIPv4Addr = ipv4Prefix.Addr().Next()
-		if !ipv4Prefix.Contains(tunat.fakeIPv4Addr) {
-			err = errors.New("ipv4 next address is out of CIDR")
-			return
+	defer func() {
+		if err != nil && unconfigure != nil {
+			unconfigure()
 		}
+	}()
+	err = excuteCommands(opts.PostCommands)
+	if err != nil {
+		return
 	}
-	if ipv6Prefix.IsValid() {
-		tunat.ipv6TCPListenerAddrPort = netip.AddrPortFrom(
-			ipv6Prefix.Addr(),
-			uint16(tunat.tcpListener.Addr().(*net.TCPAddr).Port),
-		)
-		tunat.fakeIPv6Addr = ipv6Prefix.Addr().Next()
-		if !ipv6Prefix.Contains(tunat.fakeIPv6Addr) {
-			err = errors.New("ipv6 next address is out of CIDR")
-			return
+
+	tunat = &Tunat{
+		file:            queues[0],
+		queues:          queues,
+		udpChan:         make(chan udpData, opts.UDPQueueSize),
+		udpSessions:     newUDPSessionTable(opts.MaxUDPSessions, opts.UDPSessionTimeout, opts.UDPQueueSize),
+		udpDropPolicy:   opts.UDPDropPolicy,
+		bufLen:          opts.MTU,
+		buffers:         newBufferPool(opts.MTU),
+		reassembler:     newReassembler(opts.MaxReassemblyBytes, opts.MaxReassemblyPackets, opts.ReassemblyTimeout),
+		verifyChecksums: opts.VerifyChecksums,
+		logger:          opts.Logger,
+		tcpTimeouts:     opts.TCPTimeouts,
+		rejectPolicy:    opts.RejectPolicy,
+		rejectMethod:    opts.RejectMethod,
+		admissionPolicy: opts.AdmissionPolicy,
+		dialer:          opts.PassthroughDialer,
+		deviceName:      opts.DeviceName,
+		autoRouteMark:   autoRouteMark(&opts),
+		closed:          make(chan struct{}),
+		done:            make(chan struct{}),
+		acceptChan:      make(chan acceptResult),
+		readDeadline:    makeDeadline(),
+		writeDeadline:   makeDeadline(),
+		unconfigure:     unconfigure,
+	}
+	tunat.offload, _ = tunat.file.(device.OffloadDevice)
+	for _, prefix := range []netip.Prefix{opts.IPv4Prefix, opts.IPv6Prefix} {
+		if prefix.IsValid() {
+			tunat.prefixes = append(tunat.prefixes, prefix.Masked())
 		}
 	}
+	tunat.outbound = &OutboundDialer{
+		Mark:         tunat.autoRouteMark,
+		LoopPrefixes: tunat.prefixes,
+		LoopDevice:   tunat.deviceName,
+	}
+	if tunat.dialer == nil {
+		tunat.dialer = tunat.outbound
+	}
+	err = tunat.listen(&opts)
+	if err != nil {
+		return nil, err
+	}
+	if tunat.ipv4TCPListenerAddrPort.IsValid() {
+		pool, _ := newNATPool(opts.FakeIPv4Pool, opts.IPv4Prefix.Addr())
+		tunat.ipv4NAT = newNATTable(pool, opts.MaxTCPEntries)
+	}
+	if tunat.ipv6TCPListenerAddrPort.IsValid() {
+		pool, _ := newNATPool(opts.FakeIPv6Pool, opts.IPv6Prefix.Addr())
+		tunat.ipv6NAT = newNATTable(pool, opts.MaxTCPEntries)
+	}
 
 	go tunat.start()
+	go tunat.gcLoop()
 	return
 }
 
-// Close close tun device
+// Close close tun device and listener, drop all nat map, unblock Accept and
+// ReadFromUDPAddrPort with net.ErrClosed, it is safe to call Close many times
 func (t *Tunat) Close() (err error) {
-	return t.file.Close()
+	t.shutdown(net.ErrClosed)
+	<-t.done
+	return t.closeErr
+}
+
+// Done closed when Tunat stopped, either by Close or by a device error
+func (t *Tunat) Done() <-chan struct{} {
+	return t.done
+}
+
+// Err nil until Done is closed, then net.ErrClosed if Close was called,
+// otherwise the error that stopped Tunat
+func (t *Tunat) Err() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// listen bind a listener to the address of each prefix, unless Listener or
+// ListenAddr is set. Without a working ipv6 stack, ipv6 is disabled as long as
+// ipv4 works
+func (t *Tunat) listen(opts *Options) (err error) {
+	defer func() {
+		if err != nil {
+			for _, listener := range t.tcpListeners {
+				listener.Close()
+			}
+		}
+	}()
+
+	listener := opts.Listener
+	if listener == nil && opts.ListenAddr != "" {
+		listener, err = net.Listen("tcp", opts.ListenAddr)
+		if err != nil {
+			return
+		}
+	}
+	if listener != nil {
+		t.tcpListeners = append(t.tcpListeners, listener)
+		listenerPort := uint16(listener.Addr().(*net.TCPAddr).Port)
+		if opts.IPv4Prefix.IsValid() {
+			t.ipv4TCPListenerAddrPort = netip.AddrPortFrom(opts.IPv4Prefix.Addr(), listenerPort)
+		}
+		if opts.IPv6Prefix.IsValid() {
+			t.ipv6TCPListenerAddrPort = netip.AddrPortFrom(opts.IPv6Prefix.Addr(), listenerPort)
+		}
+		return nil
+	}
+
+	if opts.IPv4Prefix.IsValid() {
+		listener, err := listenTCP(netip.AddrPortFrom(opts.IPv4Prefix.Addr(), 0))
+		if err != nil {
+			return err
+		}
+		t.tcpListeners = append(t.tcpListeners, listener)
+		listenerPort := uint16(listener.Addr().(*net.TCPAddr).Port)
+		t.ipv4TCPListenerAddrPort = netip.AddrPortFrom(opts.IPv4Prefix.Addr(), listenerPort)
+	}
+	if opts.IPv6Prefix.IsValid() {
+		listener, err := listenTCP(netip.AddrPortFrom(opts.IPv6Prefix.Addr(), 0))
+		if err != nil {
+			if !t.ipv4TCPListenerAddrPort.IsValid() {
+				return err
+			}
+			t.logger.Printf("tunat ipv6 disabled: %v", err)
+			return nil
+		}
+		t.tcpListeners = append(t.tcpListeners, listener)
+		listenerPort := uint16(listener.Addr().(*net.TCPAddr).Port)
+		t.ipv6TCPListenerAddrPort = netip.AddrPortFrom(opts.IPv6Prefix.Addr(), listenerPort)
+	}
+	return nil
 }
 
+func (t *Tunat) shutdown(reason error) {
+	t.closeOnce.Do(func() {
+		t.err = reason
+		close(t.closed)
+
+		for _, listener := range t.tcpListeners {
+			if err := listener.Close(); t.closeErr == nil {
+				t.closeErr = err
+			}
+		}
+		for _, queue := range t.queues {
+			if err := queue.Close(); t.closeErr == nil {
+				t.closeErr = err
+			}
+		}
+		if t.unconfigure != nil {
+			if err := t.unconfigure(); t.closeErr == nil {
+				t.closeErr = err
+			}
+		}
+		if t.ipv4NAT != nil {
+			t.ipv4NAT.reset()
+		}
+		if t.ipv6NAT != nil {
+			t.ipv6NAT.reset()
+		}
+	})
+}
+
+// start one worker per queue, done is closed once all of them return
 func (t *Tunat) start() {
+	defer close(t.done)
+
+	var wg sync.WaitGroup
+	for _, queue := range t.queues {
+		wg.Add(1)
+		go func(queue device.Device) {
+			defer wg.Done()
+			t.worker(queue)
+		}(queue)
+	}
+	wg.Wait()
+}
+
+// worker read and handle the packets of one queue, workers share the nat
+// tables and the UDP queues
+func (t *Tunat) worker(queue device.Device) {
+	if queue, ok := queue.(device.OffloadDevice); ok && t.offload != nil {
+		t.offloadWorker(queue)
+		return
+	}
+
 	buf := make([]byte, t.bufLen)
 	for {
-		nread, err := t.file.Read(buf)
+		nread, err := queue.Read(buf)
 		if err != nil {
-			fmt.Printf("tunat read error: %v\n", err)
+			t.readError(err)
 			return
 		}
-		packet := buf[:nread]
+		t.handlePacket(buf[:nread], nil)
+	}
+}
 
-		switch header.IPVersion(packet) {
-		case header.IPv4Version:
-			ipHeader := header.IPv4(packet)
-			switch ipHeader.TransportProtocol() {
-			case header.TCPProtocolNumber:
-				t.handleIPv4TCP(ipHeader, ipHeader.Payload())
-			case header.UDPProtocolNumber:
-				t.handleIPv4UDP(ipHeader, ipHeader.Payload())
+// readError stop Tunat unless it is already closed
+func (t *Tunat) readError(err error) {
+	select {
+	case <-t.closed:
+	default:
+		t.logger.Printf("tunat read error: %v", err)
+		t.shutdown(fmt.Errorf("tunat read: %w", err))
+	}
+}
+
+// handlePacket validate, reassemble and dispatch a packet read from the
+// device, hdr is nil unless it is read from an OffloadDevice
+func (t *Tunat) handlePacket(packet []byte, hdr *device.VirtioNetHdr) {
+	partial := isPartial(hdr)
+	switch header.IPVersion(packet) {
+	case header.IPv4Version:
+		ipHeader, ok := t.validateIPv4(packet)
+		if !ok {
+			return
+		}
+		if ipHeader.More() || ipHeader.FragmentOffset() != 0 {
+			ipHeader, ok = t.reassembleIPv4(ipHeader)
+			if !ok {
+				return
+			}
+			hdr, partial = nil, false
+		}
+		switch ipHeader.TransportProtocol() {
+		case header.TCPProtocolNumber:
+			if t.validateTCP(ipHeader.Payload(), ipHeader.SourceAddress(), ipHeader.DestinationAddress(), partial) {
+				t.handleIPv4TCP(ipHeader, ipHeader.Payload(), hdr)
+			}
+		case header.UDPProtocolNumber:
+			if udpHeader, ok := t.validateUDP(ipHeader.Payload(), ipHeader.SourceAddress(), ipHeader.DestinationAddress(), partial); ok {
+				t.handleIPv4UDP(ipHeader, udpHeader)
+			}
+		}
+	case header.IPv6Version:
+		ipHeader, ok := t.validateIPv6(packet)
+		if !ok {
+			return
+		}
+		protocol, offset, ok := ipv6Transport(ipHeader)
+		if !ok {
+			atomic.AddUint64(&t.stats.DroppedBadLength, 1)
+			return
+		}
+		if protocol == uint8(header.IPv6FragmentExtHdrIdentifier) {
+			ipHeader, ok = t.reassembleIPv6(ipHeader, offset)
+			if !ok {
+				return
+			}
+			hdr, partial = nil, false
+			protocol, offset, ok = ipv6Transport(ipHeader)
+			if !ok {
+				atomic.AddUint64(&t.stats.DroppedBadLength, 1)
+				return
+			}
+		}
+		// extension headers stay in ipHeader, so they are written back
+		transport := []byte(ipHeader[offset:])
+		switch tcpip.TransportProtocolNumber(protocol) {
+		case header.TCPProtocolNumber:
+			if t.validateTCP(transport, ipHeader.SourceAddress(), ipHeader.DestinationAddress(), partial) {
+				t.handleIPv6TCP(ipHeader, transport, hdr)
+			}
+		case header.UDPProtocolNumber:
+			if udpHeader, ok := t.validateUDP(transport, ipHeader.SourceAddress(), ipHeader.DestinationAddress(), partial); ok {
+				t.handleIPv6UDP(ipHeader, udpHeader)
 			}
-		case header.IPv6Version:
-			ipHeader := header.IPv6(packet)
-			switch ipHeader.TransportProtocol() {
-			case header.TCPProtocolNumber:
-				t.handleIPv6TCP(ipHeader, ipHeader.Payload())
-			case header.UDPProtocolNumber:
-				t.handleIPv6UDP(ipHeader, ipHeader.Payload())
+		}
+	}
+}
+
+// ipv6Transport walk the extension headers of packet, returns the protocol
+// and offset of the transport header, or of the Fragment header which ends the
+// walk until the packet is reassembled
+func ipv6Transport(packet header.IPv6) (protocol uint8, offset int, ok bool) {
+	end := header.IPv6MinimumSize + int(packet.PayloadLength())
+	if end > len(packet) {
+		return
+	}
+	protocol = packet.NextHeader()
+	offset = header.IPv6MinimumSize
+	for {
+		switch header.IPv6ExtensionHeaderIdentifier(protocol) {
+		case header.IPv6HopByHopOptionsExtHdrIdentifier,
+			header.IPv6RoutingExtHdrIdentifier,
+			header.IPv6DestinationOptionsExtHdrIdentifier:
+			if offset+8 > end {
+				return 0, 0, false
 			}
+			protocol, offset = packet[offset], offset+(int(packet[offset+1])+1)*8
+		default:
+			return protocol, offset, offset <= end
 		}
 	}
 }
@@ -1,11 +1,13 @@
 package tunat
 
 import (
-	"errors"
+	"context"
 	"net"
 	"net/netip"
+	"syscall"
 
 	"github.com/FH0/tunat/device"
+	"golang.org/x/sys/unix"
 )
 
 // NewFromUnixSocket new a Tunat from unix
@@ -16,50 +18,73 @@ func NewFromUnixSocket(path string,
 	preCommands []string,
 	postCommands []string,
 ) (tunat *Tunat, err error) {
-	tunat = &Tunat{
-		udpChan: make(chan udpData, 100),
-		bufLen:  bufLen,
-	}
+	return NewWithOptions(
+		WithUnixSocket(path),
+		WithIPv4Prefix(ipv4Prefix),
+		WithIPv6Prefix(ipv6Prefix),
+		WithMTU(bufLen),
+		WithPreCommands(preCommands...),
+		WithPostCommands(postCommands...),
+	)
+}
 
-	err = excuteCommands(preCommands)
-	if err != nil {
-		return
-	}
-	tunat.file, err = device.NewFromUnixSocket(path)
-	if err != nil {
-		return
-	}
-	err = excuteCommands(postCommands)
-	if err != nil {
-		return
-	}
-	tunat.tcpListener, err = net.Listen("tcp", "[::]:0")
-	if err != nil {
-		return
-	}
-	if ipv4Prefix.IsValid() {
-		tunat.ipv4TCPListenerAddrPort = netip.AddrPortFrom(
-			ipv4Prefix.Addr(),
-			uint16(tunat.tcpListener.Addr().(*net.TCPAddr).Port),
-		)
-		tunat.fakeIPv4Addr = ipv4Prefix.Addr().Next()
-		if !ipv4Prefix.Contains(tunat.fakeIPv4Addr) {
-			err = errors.New("ipv4 next address is out of CIDR")
-			return
+// validatePlatform every option applies to linux
+func (o *Options) validatePlatform() error {
+	return nil
+}
+
+// openDevice returns the queues of the device, at least one
+func openDevice(opts *Options) (queues []device.Device, err error) {
+	switch {
+	case opts.Device != nil:
+		return []device.Device{opts.Device}, nil
+	case len(opts.Devices) != 0:
+		return opts.Devices, nil
+	case opts.UnixSocketPath != "":
+		file, err := device.NewFromUnixSocket(opts.UnixSocketPath)
+		if err != nil {
+			return nil, err
 		}
-	}
-	if ipv6Prefix.IsValid() {
-		tunat.ipv6TCPListenerAddrPort = netip.AddrPortFrom(
-			ipv6Prefix.Addr(),
-			uint16(tunat.tcpListener.Addr().(*net.TCPAddr).Port),
-		)
-		tunat.fakeIPv6Addr = ipv6Prefix.Addr().Next()
-		if !ipv6Prefix.Contains(tunat.fakeIPv6Addr) {
-			err = errors.New("ipv6 next address is out of CIDR")
-			return
+		return []device.Device{file}, nil
+	case opts.Offload:
+		devices, err := device.NewOffload(opts.DeviceName, opts.Queues)
+		if err != nil {
+			return nil, err
+		}
+		for _, dev := range devices {
+			queues = append(queues, dev)
+		}
+		return queues, nil
+	case opts.Queues > 1:
+		files, err := device.NewMultiQueue(opts.DeviceName, opts.Queues)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			queues = append(queues, file)
 		}
+		return queues, nil
+	default:
+		file, err := device.New(opts.DeviceName)
+		if err != nil {
+			return nil, err
+		}
+		return []device.Device{file}, nil
 	}
+}
 
-	go tunat.start()
-	return
+// listenTCP IP_FREEBIND allows binding the tun address before it is assigned
+func listenTCP(addr netip.AddrPort) (net.Listener, error) {
+	listenConfig := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) (err error) {
+			controlErr := c.Control(func(fd uintptr) {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_FREEBIND, 1)
+			})
+			if controlErr != nil {
+				return controlErr
+			}
+			return
+		},
+	}
+	return listenConfig.Listen(context.Background(), "tcp", addr.String())
 }
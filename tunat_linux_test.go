@@ -0,0 +1,54 @@
+package tunat
+
+import (
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestCloseUnixSocket the fd received from the unix socket is blocking, as
+// the one of Android VpnService
+func TestCloseUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tun.sock")
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[1])
+
+	go func() {
+		defer unix.Close(fds[0])
+		for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+			conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+			if err != nil {
+				continue
+			}
+			defer conn.Close()
+			_, _, _ = conn.WriteMsgUnix([]byte("tun"), unix.UnixRights(fds[0]), nil)
+			return
+		}
+	}()
+	tn, err := NewWithOptions(WithUnixSocket(path), WithIPv4Prefix(netip.MustParsePrefix("10.0.0.1/24")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// let the worker block in Read
+	time.Sleep(100 * time.Millisecond)
+	closed := make(chan error, 1)
+	go func() {
+		closed <- tn.Close()
+	}()
+	select {
+	case err = <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Close blocked by Read")
+	}
+}
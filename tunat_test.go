@@ -0,0 +1,656 @@
+package tunat
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/FH0/tunat/device"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+func newTestTunat(t testing.TB) (*Tunat, device.Device) {
+	t.Helper()
+
+	tunSide, testSide := device.Pipe()
+	tn, err := NewFromDevice(
+		tunSide,
+		netip.MustParsePrefix("10.0.0.1/24"),
+		netip.MustParsePrefix("fd::1/120"),
+		1500,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		tn.Close()
+	})
+	return tn, testSide
+}
+
+func buildTCP(saddr, daddr netip.AddrPort, flags header.TCPFlags, payload []byte) []byte {
+	var ipHeaderLen int
+	if saddr.Addr().Is4() {
+		ipHeaderLen = header.IPv4MinimumSize
+	} else {
+		ipHeaderLen = header.IPv6MinimumSize
+	}
+	packet := make([]byte, ipHeaderLen+header.TCPMinimumSize+len(payload))
+	copy(packet[ipHeaderLen+header.TCPMinimumSize:], payload)
+
+	if saddr.Addr().Is4() {
+		ipHeader := header.IPv4(packet)
+		ipHeader.Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(packet)),
+			TTL:         64,
+			Protocol:    uint8(header.TCPProtocolNumber),
+			SrcAddr:     tcpip.Address(saddr.Addr().AsSlice()),
+			DstAddr:     tcpip.Address(daddr.Addr().AsSlice()),
+		})
+		ipHeader.SetChecksum(^ipHeader.CalculateChecksum())
+	} else {
+		header.IPv6(packet).Encode(&header.IPv6Fields{
+			PayloadLength:     uint16(header.TCPMinimumSize + len(payload)),
+			TransportProtocol: header.TCPProtocolNumber,
+			HopLimit:          64,
+			SrcAddr:           tcpip.Address(saddr.Addr().AsSlice()),
+			DstAddr:           tcpip.Address(daddr.Addr().AsSlice()),
+		})
+	}
+
+	tcpHeader := header.TCP(packet[ipHeaderLen:])
+	tcpHeader.Encode(&header.TCPFields{
+		SrcPort:    saddr.Port(),
+		DstPort:    daddr.Port(),
+		SeqNum:     1000,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      flags,
+		WindowSize: 65535,
+	})
+	tcpHeader.SetChecksum(^tcpHeader.CalculateChecksum(
+		header.Checksum(payload, header.PseudoHeaderChecksum(
+			header.TCPProtocolNumber,
+			tcpip.Address(saddr.Addr().AsSlice()),
+			tcpip.Address(daddr.Addr().AsSlice()),
+			uint16(len(tcpHeader)),
+		)),
+	))
+	return packet
+}
+
+func buildUDP(saddr, daddr netip.AddrPort, payload []byte) []byte {
+	tn := &Tunat{file: &recordDevice{}, bufLen: 1500, buffers: newBufferPool(1500)}
+	_, _ = tn.WriteToUDPAddrPort(payload, saddr, daddr)
+	return tn.file.(*recordDevice).packets[0]
+}
+
+// recordDevice keep every written packet
+type recordDevice struct {
+	packets [][]byte
+}
+
+func (d *recordDevice) Read(buf []byte) (int, error) { select {} }
+
+func (d *recordDevice) Write(buf []byte) (int, error) {
+	d.packets = append(d.packets, append([]byte(nil), buf...))
+	return len(buf), nil
+}
+
+func (d *recordDevice) Close() error { return nil }
+
+func readPacket(t testing.TB, dev device.Device) []byte {
+	t.Helper()
+
+	ch := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 65535)
+		nread, err := dev.Read(buf)
+		if err != nil {
+			close(ch)
+			return
+		}
+		ch <- buf[:nread]
+	}()
+	select {
+	case packet, ok := <-ch:
+		if !ok {
+			t.Fatal("device closed")
+		}
+		return packet
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	return nil
+}
+
+// parseTCP check checksums and return addresses of a TCP packet
+func parseTCP(t testing.TB, packet []byte) (saddr, daddr netip.AddrPort, tcpHeader header.TCP) {
+	t.Helper()
+
+	var src, dst tcpip.Address
+	switch header.IPVersion(packet) {
+	case header.IPv4Version:
+		ipHeader := header.IPv4(packet)
+		if !ipHeader.IsChecksumValid() {
+			t.Fatal("bad ipv4 checksum")
+		}
+		src, dst, tcpHeader = ipHeader.SourceAddress(), ipHeader.DestinationAddress(), ipHeader.Payload()
+	case header.IPv6Version:
+		ipHeader := header.IPv6(packet)
+		src, dst, tcpHeader = ipHeader.SourceAddress(), ipHeader.DestinationAddress(), ipHeader.Payload()
+	default:
+		t.Fatal("not an ip packet")
+	}
+	if !tcpHeader.IsChecksumValid(src, dst, header.Checksum(tcpHeader.Payload(), 0), uint16(len(tcpHeader.Payload()))) {
+		t.Fatal("bad tcp checksum")
+	}
+
+	sip, _ := netip.AddrFromSlice([]byte(src))
+	dip, _ := netip.AddrFromSlice([]byte(dst))
+	return netip.AddrPortFrom(sip, tcpHeader.SourcePort()), netip.AddrPortFrom(dip, tcpHeader.DestinationPort()), tcpHeader
+}
+
+func TestTCPNAT(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		saddr  netip.AddrPort
+		daddr  netip.AddrPort
+		prefix netip.Prefix
+	}{
+		{"ipv4", netip.MustParseAddrPort("10.0.0.1:1234"), netip.MustParseAddrPort("1.2.3.4:80"), netip.MustParsePrefix("10.0.0.0/24")},
+		{"ipv6", netip.MustParseAddrPort("[fd::1]:1234"), netip.MustParseAddrPort("[2001:db8::1]:80"), netip.MustParsePrefix("fd::/120")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tn, dev := newTestTunat(t)
+			listenerAddr := tn.ipv4TCPListenerAddrPort
+			if tt.saddr.Addr().Is6() {
+				listenerAddr = tn.ipv6TCPListenerAddrPort
+			}
+
+			_, _ = dev.Write(buildTCP(tt.saddr, tt.daddr, header.TCPFlagSyn, nil))
+			fakeAddr, daddr, _ := parseTCP(t, readPacket(t, dev))
+			if !tt.prefix.Contains(fakeAddr.Addr()) || fakeAddr.Addr() == listenerAddr.Addr() || daddr != listenerAddr {
+				t.Fatalf("syn rewritten to %v -> %v", fakeAddr, daddr)
+			}
+
+			_, _ = dev.Write(buildTCP(listenerAddr, fakeAddr, header.TCPFlagSyn|header.TCPFlagAck, nil))
+			saddr, daddr, _ := parseTCP(t, readPacket(t, dev))
+			if saddr != tt.daddr || daddr != tt.saddr {
+				t.Fatalf("syn ack rewritten to %v -> %v", saddr, daddr)
+			}
+
+			_, _ = dev.Write(buildTCP(tt.saddr, tt.daddr, header.TCPFlagAck, []byte("abcd")))
+			saddr, daddr, tcpHeader := parseTCP(t, readPacket(t, dev))
+			if saddr != fakeAddr || daddr != listenerAddr || string(tcpHeader.Payload()) != "abcd" {
+				t.Fatalf("ack rewritten to %v -> %v %q", saddr, daddr, tcpHeader.Payload())
+			}
+		})
+	}
+}
+
+func TestUDP(t *testing.T) {
+	tn, dev := newTestTunat(t)
+
+	for _, tt := range []struct {
+		saddr netip.AddrPort
+		daddr netip.AddrPort
+	}{
+		{netip.MustParseAddrPort("10.0.0.1:1234"), netip.MustParseAddrPort("1.2.3.4:53")},
+		{netip.MustParseAddrPort("[fd::1]:1234"), netip.MustParseAddrPort("[2001:db8::1]:53")},
+	} {
+		_, _ = dev.Write(buildUDP(tt.saddr, tt.daddr, []byte("abcd")))
+		buf := make([]byte, 100)
+		nread, saddr, daddr, err := tn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saddr != tt.saddr || daddr != tt.daddr || string(buf[:nread]) != "abcd" {
+			t.Fatalf("read %v -> %v %q", saddr, daddr, buf[:nread])
+		}
+
+		_, err = tn.WriteToUDPAddrPort([]byte("efgh"), tt.daddr, tt.saddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet := readPacket(t, dev)
+		var udpHeader header.UDP
+		if saddr.Addr().Is4() {
+			udpHeader = header.IPv4(packet).Payload()
+		} else {
+			udpHeader = header.IPv6(packet).Payload()
+		}
+		if udpHeader.SourcePort() != tt.daddr.Port() || udpHeader.DestinationPort() != tt.saddr.Port() ||
+			string(udpHeader.Payload()) != "efgh" {
+			t.Fatalf("write %v %q", udpHeader.SourcePort(), udpHeader.Payload())
+		}
+	}
+}
+
+func TestUDPDropPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		policy UDPDropPolicy
+		want   []string
+	}{
+		{UDPDropNewest, []string{"1", "2"}},
+		{UDPDropOldest, []string{"2", "3"}},
+	} {
+		tn, dev := newTunatWithOptions(t, WithUDPQueueSize(2), WithUDPDropPolicy(tt.policy))
+		saddr := netip.MustParseAddrPort("10.0.0.1:1234")
+		daddr := netip.MustParseAddrPort("1.2.3.4:53")
+		for _, payload := range []string{"1", "2", "3"} {
+			_, _ = dev.Write(buildUDP(saddr, daddr, []byte(payload)))
+		}
+
+		// a full UDP queue does not block TCP
+		_, _ = dev.Write(buildTCP(saddr, daddr, header.TCPFlagSyn, nil))
+		readPacket(t, dev)
+		if stats := tn.Stats(); stats.DroppedUDPPackets != 1 || stats.UDPQueueLen != 2 {
+			t.Fatalf("%d dropped, %d queued", stats.DroppedUDPPackets, stats.UDPQueueLen)
+		}
+
+		buf := make([]byte, 100)
+		for _, want := range tt.want {
+			nread, _, _, err := tn.ReadFromUDPAddrPort(buf)
+			if err != nil || string(buf[:nread]) != want {
+				t.Fatalf("policy %v read %q %v, want %q", tt.policy, buf[:nread], err, want)
+			}
+		}
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	dev, _ := device.Pipe()
+	for _, tt := range []struct {
+		option  string
+		options []Option
+	}{
+		{"Device", []Option{WithIPv4Prefix(netip.MustParsePrefix("10.0.0.1/24"))}},
+		{"Device", []Option{WithDevice(dev), WithDeviceName("tun1"), WithIPv4Prefix(netip.MustParsePrefix("10.0.0.1/24"))}},
+		{"Device", []Option{WithDevice(dev), WithDevices(dev), WithIPv4Prefix(netip.MustParsePrefix("10.0.0.1/24"))}},
+		{"Queues", []Option{WithDevice(dev), WithQueues(2), WithIPv4Prefix(netip.MustParsePrefix("10.0.0.1/24"))}},
+		{"Offload", []Option{WithDevice(dev), WithOffload(true), WithIPv4Prefix(netip.MustParsePrefix("10.0.0.1/24"))}},
+		{"Configure", []Option{WithDevice(dev), WithConfigure(true), WithIPv4Prefix(netip.MustParsePrefix("10.0.0.1/24"))}},
+		{"Routes", []Option{WithDeviceName("tun1"), WithRoutes(netip.MustParsePrefix("0.0.0.0/0")), WithIPv4Prefix(netip.MustParsePrefix("10.0.0.1/24"))}},
+		{"Routes", []Option{WithDeviceName("tun1"), WithConfigure(true), WithRoutes(netip.Prefix{}), WithIPv4Prefix(netip.MustParsePrefix("10.0.0.1/24"))}},
+		{"AutoRoute", []Option{WithDeviceName("tun1"), WithAutoRoute(true), WithIPv4Prefix(netip.MustParsePrefix("10.0.0.1/24"))}},
+		{"AutoRouteTable", []Option{WithDeviceName("tun1"), WithConfigure(true), WithAutoRoute(true), WithAutoRouteTable(254), WithIPv4Prefix(netip.MustParsePrefix("10.0.0.1/24"))}},
+		{"AutoRoutePriority", []Option{WithDeviceName("tun1"), WithConfigure(true), WithAutoRoute(true), WithAutoRoutePriority(32766), WithIPv4Prefix(netip.MustParsePrefix("10.0.0.1/24"))}},
+		{"AutoRouteMark", []Option{WithDeviceName("tun1"), WithConfigure(true), WithAutoRoute(true), WithAutoRouteMark(0), WithIPv4Prefix(netip.MustParsePrefix("10.0.0.1/24"))}},
+		{"ExcludeRoutes", []Option{WithDeviceName("tun1"), WithConfigure(true), WithExcludeRoutes(netip.MustParsePrefix("192.168.0.0/16")), WithIPv4Prefix(netip.MustParsePrefix("10.0.0.1/24"))}},
+		{"IPv4Prefix", []Option{WithDevice(dev)}},
+		{"FakeIPv4Pool", []Option{WithDevice(dev), WithIPv4Prefix(netip.MustParsePrefix("10.0.0.1/32"))}},
+		{"FakeIPv4Pool", []Option{WithDevice(dev), WithIPv4Prefix(netip.MustParsePrefix("10.0.0.1/24")), WithFakeIPv4Pool(netip.MustParsePrefix("10.0.1.0/28"))}},
+		{"IPv6Prefix", []Option{WithDevice(dev), WithIPv6Prefix(netip.MustParsePrefix("10.0.0.1/24"))}},
+		{"MTU", []Option{WithDevice(dev), WithIPv4Prefix(netip.MustParsePrefix("10.0.0.1/24")), WithMTU(0)}},
+		{"ListenAddr", []Option{WithDevice(dev), WithIPv4Prefix(netip.MustParsePrefix("10.0.0.1/24")), WithListenAddr("localhost")}},
+		{"Listener", []Option{WithDevice(dev), WithIPv4Prefix(netip.MustParsePrefix("10.0.0.1/24")), WithListenAddr("127.0.0.1:0"), WithListener(&net.TCPListener{})}},
+		{"UDPQueueSize", []Option{WithDevice(dev), WithIPv4Prefix(netip.MustParsePrefix("10.0.0.1/24")), WithUDPQueueSize(0)}},
+	} {
+		_, err := NewWithOptions(tt.options...)
+		optionErr, ok := err.(*OptionError)
+		if !ok || optionErr.Option != tt.option {
+			t.Fatalf("want %v error, got %v", tt.option, err)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	tn, _ := newTestTunat(t)
+
+	errChan := make(chan error, 2)
+	go func() {
+		_, _, _, err := tn.ReadFromUDPAddrPort(make([]byte, 100))
+		errChan <- err
+	}()
+	go func() {
+		_, err := tn.Accept()
+		errChan <- err
+	}()
+
+	if err := tn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errChan:
+			if !errors.Is(err, net.ErrClosed) {
+				t.Fatalf("want net.ErrClosed, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	<-tn.Done()
+	if tn.Err() != net.ErrClosed {
+		t.Fatalf("want net.ErrClosed, got %v", tn.Err())
+	}
+}
+
+func TestDeviceError(t *testing.T) {
+	tn, dev := newTestTunat(t)
+	if tn.Err() != nil {
+		t.Fatal(tn.Err())
+	}
+
+	dev.Close()
+	select {
+	case <-tn.Done():
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	if !errors.Is(tn.Err(), os.ErrClosed) {
+		t.Fatalf("want os.ErrClosed, got %v", tn.Err())
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	tn, dev := newTestTunat(t)
+
+	_ = tn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, _, _, err := tn.ReadFromUDPAddrPort(make([]byte, 100))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("want os.ErrDeadlineExceeded, got %v", err)
+	}
+
+	_ = tn.SetReadDeadline(time.Time{})
+	_, _ = dev.Write(buildUDP(netip.MustParseAddrPort("10.0.0.1:1234"), netip.MustParseAddrPort("1.2.3.4:53"), []byte("abcd")))
+	if _, _, _, err = tn.ReadFromUDPAddrPort(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = tn.SetWriteDeadline(time.Now().Add(-time.Second))
+	_, err = tn.WriteToUDPAddrPort([]byte("abcd"), netip.MustParseAddrPort("1.2.3.4:53"), netip.MustParseAddrPort("10.0.0.1:1234"))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("want os.ErrDeadlineExceeded, got %v", err)
+	}
+}
+
+func TestContext(t *testing.T) {
+	tn, _ := newTestTunat(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := tn.AcceptContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("want context.DeadlineExceeded, got %v", err)
+	}
+	if _, _, _, err := tn.ReadFromUDPAddrPortContext(ctx, make([]byte, 100)); err != context.DeadlineExceeded {
+		t.Fatalf("want context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestTCPListener(t *testing.T) {
+	tn, _ := newTestTunat(t)
+
+	listener := tn.TCPListener()
+	if listener.Addr().String() != tn.ipv4TCPListenerAddrPort.String() {
+		t.Fatalf("listener addr %v", listener.Addr())
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := listener.Accept()
+		errChan <- err
+	}()
+	listener.Close()
+	if err := <-errChan; err != net.ErrClosed {
+		t.Fatalf("want net.ErrClosed, got %v", err)
+	}
+	if tn.Err() != nil {
+		t.Fatal("closing listener closed tunat")
+	}
+}
+
+func TestListen(t *testing.T) {
+	tn, _ := newTestTunat(t)
+
+	if len(tn.tcpListeners) != 2 {
+		t.Fatalf("%d listeners", len(tn.tcpListeners))
+	}
+	for i, listenerAddr := range []netip.AddrPort{tn.ipv4TCPListenerAddrPort, tn.ipv6TCPListenerAddrPort} {
+		addr := tn.tcpListeners[i].Addr().(*net.TCPAddr).AddrPort()
+		if addr.Addr().Unmap() != listenerAddr.Addr() || addr.Port() != listenerAddr.Port() {
+			t.Fatalf("listening on %v, want %v", addr, listenerAddr)
+		}
+	}
+}
+
+func TestUnknownTCPPeer(t *testing.T) {
+	tn, _ := newTunatWithOptions(t, WithListenAddr("127.0.0.1:0"))
+
+	conn, err := net.Dial("tcp", tn.tcpListeners[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := tn.AcceptContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("want context.DeadlineExceeded, got %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("unknown peer not closed")
+	}
+	if stats := tn.Stats(); stats.UnknownTCPPeers != 1 {
+		t.Fatalf("%d unknown peers", stats.UnknownTCPPeers)
+	}
+}
+
+func TestListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn, dev := newTunatWithOptions(t, WithListener(listener))
+	listenerPort := uint16(listener.Addr().(*net.TCPAddr).Port)
+	if tn.ipv4TCPListenerAddrPort.Port() != listenerPort || tn.ipv6TCPListenerAddrPort.Port() != listenerPort {
+		t.Fatalf("listener addrs %v %v", tn.ipv4TCPListenerAddrPort, tn.ipv6TCPListenerAddrPort)
+	}
+
+	saddr := netip.MustParseAddrPort("10.0.0.1:1234")
+	daddr := netip.MustParseAddrPort("1.2.3.4:80")
+	_, _ = dev.Write(buildTCP(saddr, daddr, header.TCPFlagSyn, nil))
+	fakeAddr, _, _ := parseTCP(t, readPacket(t, dev))
+	for _, remote := range []netip.AddrPort{fakeAddr, netip.AddrPortFrom(netip.AddrFrom16(fakeAddr.Addr().As16()), fakeAddr.Port())} {
+		if src, dst, ok := tn.Lookup(remote); !ok || src != saddr || dst != daddr {
+			t.Fatalf("lookup %v: %v -> %v", remote, src, dst)
+		}
+	}
+	if _, _, ok := tn.Lookup(saddr); ok {
+		t.Fatal("lookup of a non fake address")
+	}
+
+	tn.Close()
+	if _, err := listener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("want net.ErrClosed, got %v", err)
+	}
+}
+
+func TestUDPConn(t *testing.T) {
+	tn, dev := newTestTunat(t)
+	conn := tn.UDPConn()
+	defer conn.Close()
+
+	saddr := netip.MustParseAddrPort("10.0.0.1:1234")
+	daddr := netip.MustParseAddrPort("1.2.3.4:53")
+	_, _ = dev.Write(buildUDP(saddr, daddr, []byte("abcd")))
+	buf := make([]byte, 100)
+	nread, addr, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != saddr.String() || string(buf[:nread]) != "abcd" {
+		t.Fatalf("read %v %q", addr, buf[:nread])
+	}
+
+	if _, err = conn.WriteTo([]byte("efgh"), addr); err != nil {
+		t.Fatal(err)
+	}
+	udpHeader := header.UDP(header.IPv4(readPacket(t, dev)).Payload())
+	if udpHeader.SourcePort() != daddr.Port() || string(udpHeader.Payload()) != "efgh" {
+		t.Fatalf("write %v %q", udpHeader.SourcePort(), udpHeader.Payload())
+	}
+
+	if _, err = conn.WriteTo([]byte("efgh"), net.UDPAddrFromAddrPort(daddr)); err == nil {
+		t.Fatal("write to unknown address")
+	}
+}
+
+// withExtensionHeaders insert a Hop-by-Hop and a Destination Options header
+// after the fixed header of an ipv6 packet
+func withExtensionHeaders(packet header.IPv6) header.IPv6 {
+	extensionHeaders := []byte{
+		uint8(header.IPv6DestinationOptionsExtHdrIdentifier), 0, 1, 4, 0, 0, 0, 0,
+		packet.NextHeader(), 0, 1, 4, 0, 0, 0, 0,
+	}
+	withHeaders := header.IPv6(append(append(append([]byte(nil), packet[:header.IPv6MinimumSize]...), extensionHeaders...), packet[header.IPv6MinimumSize:]...))
+	withHeaders.SetNextHeader(uint8(header.IPv6HopByHopOptionsExtHdrIdentifier))
+	withHeaders.SetPayloadLength(packet.PayloadLength() + uint16(len(extensionHeaders)))
+	return withHeaders
+}
+
+func TestIPv6ExtensionHeaders(t *testing.T) {
+	tn, dev := newTestTunat(t)
+	saddr := netip.MustParseAddrPort("[fd::1]:1234")
+	daddr := netip.MustParseAddrPort("[2001:db8::1]:80")
+
+	packet := withExtensionHeaders(buildTCP(saddr, daddr, header.TCPFlagSyn, nil))
+	_, _ = dev.Write(packet)
+	reply := header.IPv6(readPacket(t, dev))
+	if string(reply[header.IPv6MinimumSize:header.IPv6MinimumSize+16]) != string(packet[header.IPv6MinimumSize:header.IPv6MinimumSize+16]) {
+		t.Fatal("extension headers not preserved")
+	}
+	tcpHeader := header.TCP(reply[header.IPv6MinimumSize+16:])
+	if !tcpHeader.IsChecksumValid(reply.SourceAddress(), reply.DestinationAddress(), 0, 0) ||
+		tcpHeader.DestinationPort() != tn.ipv6TCPListenerAddrPort.Port() {
+		t.Fatal("tcp not rewritten")
+	}
+
+	_, _ = dev.Write(withExtensionHeaders(buildUDP(saddr, daddr, []byte("abcd"))))
+	payload := make([]byte, 3000)
+	for _, fragment := range buildFragments(saddr, daddr, payload, 1280) {
+		_, _ = dev.Write(withExtensionHeaders(fragment))
+	}
+	buf := make([]byte, 4000)
+	for _, want := range [][]byte{[]byte("abcd"), payload} {
+		nread, readSaddr, readDaddr, err := tn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if readSaddr != saddr || readDaddr != daddr || string(buf[:nread]) != string(want) {
+			t.Fatalf("read %v -> %v %d bytes", readSaddr, readDaddr, nread)
+		}
+	}
+}
+
+// newQueuesTunat a Tunat reading n pipes, queues are the test sides
+func newQueuesTunat(t testing.TB, n int) (tn *Tunat, queues []device.Device) {
+	t.Helper()
+
+	var tunSides []device.Device
+	for i := 0; i < n; i++ {
+		tunSide, testSide := device.Pipe()
+		tunSides = append(tunSides, tunSide)
+		queues = append(queues, testSide)
+	}
+	tn, err := NewWithOptions(
+		WithDevices(tunSides...),
+		WithIPv4Prefix(netip.MustParsePrefix("10.0.0.1/24")),
+		WithIPv6Prefix(netip.MustParsePrefix("fd::1/120")),
+		WithUDPQueueSize(1000),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		tn.Close()
+	})
+	return tn, queues
+}
+
+func TestQueues(t *testing.T) {
+	tn, queues := newQueuesTunat(t, 4)
+	daddr := netip.MustParseAddrPort("1.2.3.4:80")
+
+	// every queue is read, replies are written to the first one
+	fakeAddrs := make(map[netip.AddrPort]bool)
+	for i, queue := range queues {
+		saddr := netip.AddrPortFrom(netip.MustParseAddr("10.0.0.1"), uint16(1000+i))
+		_, _ = queue.Write(buildTCP(saddr, daddr, header.TCPFlagSyn, nil))
+		fakeAddr, _, _ := parseTCP(t, readPacket(t, queues[0]))
+		fakeAddrs[fakeAddr] = true
+	}
+	if len(fakeAddrs) != len(queues) {
+		t.Fatalf("%d fake addresses", len(fakeAddrs))
+	}
+
+	// workers share the UDP queue
+	for i := 0; i < 100; i++ {
+		for _, queue := range queues {
+			go queue.Write(buildUDP(netip.MustParseAddrPort("10.0.0.1:1234"), netip.MustParseAddrPort("1.2.3.4:53"), []byte("abcd")))
+		}
+	}
+	buf := make([]byte, 100)
+	for i := 0; i < 100*len(queues); i++ {
+		if _, _, _, err := tn.ReadFromUDPAddrPort(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, queue := range queues {
+		if _, err := queue.Write([]byte{0}); err == nil {
+			t.Fatal("queue not closed")
+		}
+	}
+}
+
+// BenchmarkQueues NAT'd TCP segments per second through one or several
+// queues, each queue is fed by its own goroutine
+func BenchmarkQueues(b *testing.B) {
+	for _, n := range []int{1, 4} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			_, queues := newQueuesTunat(b, n)
+			daddr := netip.MustParseAddrPort("1.2.3.4:80")
+			packets := make([][]byte, n)
+			for i, queue := range queues {
+				saddr := netip.AddrPortFrom(netip.MustParseAddr("10.0.0.1"), uint16(1000+i))
+				_, _ = queue.Write(buildTCP(saddr, daddr, header.TCPFlagSyn, nil))
+				readPacket(b, queues[0])
+				packets[i] = buildTCP(saddr, daddr, header.TCPFlagAck, make([]byte, 1400))
+			}
+
+			done := make(chan struct{})
+			go func() {
+				buf := make([]byte, 1500)
+				for i := 0; i < b.N; i++ {
+					if _, err := queues[0].Read(buf); err != nil {
+						break
+					}
+				}
+				close(done)
+			}()
+
+			b.SetBytes(int64(len(packets[0])))
+			b.ResetTimer()
+			for i, queue := range queues {
+				go func(queue device.Device, packet []byte, count int) {
+					for j := 0; j < count; j++ {
+						_, _ = queue.Write(append([]byte(nil), packet...))
+					}
+				}(queue, packets[i], b.N/n+1)
+			}
+			<-done
+		})
+	}
+}
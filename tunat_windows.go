@@ -0,0 +1,50 @@
+package tunat
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/FH0/tunat/device"
+)
+
+// validatePlatform reject the options that only apply to linux
+func (o *Options) validatePlatform() error {
+	if o.UnixSocketPath != "" {
+		return &OptionError{"UnixSocketPath", "not supported on windows"}
+	}
+	if o.Queues > 1 {
+		return &OptionError{"Queues", "not supported on windows"}
+	}
+	if o.Offload {
+		return &OptionError{"Offload", "not supported on windows"}
+	}
+	// AutoRoute and Routes require Configure
+	if o.Configure {
+		return &OptionError{"Configure", "not supported on windows"}
+	}
+	return nil
+}
+
+func openDevice(opts *Options) (queues []device.Device, err error) {
+	switch {
+	case opts.Device != nil:
+		return []device.Device{opts.Device}, nil
+	case len(opts.Devices) != 0:
+		return opts.Devices, nil
+	default:
+		file, err := device.New(opts.DeviceName)
+		if err != nil {
+			return nil, err
+		}
+		return []device.Device{file}, nil
+	}
+}
+
+// configureDevice Configure is rejected by validatePlatform
+func configureDevice(opts *Options) (unconfigure func() error, err error) {
+	return nil, nil
+}
+
+func listenTCP(addr netip.AddrPort) (net.Listener, error) {
+	return net.Listen("tcp", addr.String())
+}
@@ -1,41 +1,225 @@
 package tunat
 
 import (
+	"context"
+	"net"
 	"net/netip"
+	"os"
+	"sync/atomic"
+	"time"
 
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 )
 
+// UDPDropPolicy which packet is dropped when a UDP queue is full
+type UDPDropPolicy int
+
+const (
+	// UDPDropNewest drop the arriving packet
+	UDPDropNewest UDPDropPolicy = iota
+	// UDPDropOldest drop the packet waiting longest to make room
+	UDPDropOldest
+)
+
 type udpData struct {
 	payload []byte
+	buf     *[]byte // pooled buffer of payload
 	saddr   netip.AddrPort
 	daddr   netip.AddrPort
 }
 
+// UDPMessage one UDP packet of ReadBatch and WriteBatch
+type UDPMessage struct {
+	// Payload the buffer for ReadBatch, the payload for WriteBatch
+	Payload []byte
+	// N bytes read into Payload by ReadBatch
+	N int
+	// Source source address of the packet
+	Source netip.AddrPort
+	// Destination destination address of the packet
+	Destination netip.AddrPort
+}
+
+// releaseUDP give the buffer of a consumed or dropped packet back
+func (t *Tunat) releaseUDP(data udpData) {
+	t.buffers.put(data.buf)
+}
+
+// queueUDP never blocks the device read loop, a full queue drops a packet
+// by the UDPDropPolicy
+func (t *Tunat) queueUDP(queue chan udpData, data udpData) {
+	for {
+		select {
+		case queue <- data:
+			return
+		default:
+		}
+		atomic.AddUint64(&t.stats.DroppedUDPPackets, 1)
+		if t.udpDropPolicy != UDPDropOldest {
+			t.releaseUDP(data)
+			return
+		}
+		select {
+		case oldest := <-queue:
+			t.releaseUDP(oldest)
+		default:
+		}
+	}
+}
+
 // ReadFromUDPAddrPort like net package
 func (t *Tunat) ReadFromUDPAddrPort(payload []byte) (nread int, saddr, daddr netip.AddrPort, err error) {
-	udpData := <-t.udpChan
-	nread = copy(payload, udpData.payload)
-	return nread, udpData.saddr, udpData.daddr, nil
+	return t.ReadFromUDPAddrPortContext(context.Background(), payload)
+}
+
+// ReadFromUDPAddrPortContext like ReadFromUDPAddrPort, but returns ctx.Err()
+// once ctx is done
+func (t *Tunat) ReadFromUDPAddrPortContext(ctx context.Context, payload []byte) (nread int, saddr, daddr netip.AddrPort, err error) {
+	return t.readUDP(ctx, payload, nil, &t.readDeadline)
+}
+
+// readUDP returns net.ErrClosed once stop is closed
+func (t *Tunat) readUDP(ctx context.Context,
+	payload []byte,
+	stop <-chan struct{},
+	readDeadline *deadline,
+) (nread int, saddr, daddr netip.AddrPort, err error) {
+	data, err := t.receiveUDP(ctx, stop, readDeadline)
+	if err != nil {
+		return
+	}
+	nread = copy(payload, data.payload)
+	t.releaseUDP(data)
+	return nread, data.saddr, data.daddr, nil
+}
+
+// receiveUDP the caller releases data
+func (t *Tunat) receiveUDP(ctx context.Context, stop <-chan struct{}, readDeadline *deadline) (data udpData, err error) {
+	select {
+	case <-t.closed:
+		return data, net.ErrClosed
+	case <-stop:
+		return data, net.ErrClosed
+	case <-readDeadline.wait():
+		return data, os.ErrDeadlineExceeded
+	default:
+	}
+
+	select {
+	case data = <-t.udpChan:
+		return data, nil
+	case <-t.closed:
+		return data, net.ErrClosed
+	case <-stop:
+		return data, net.ErrClosed
+	case <-readDeadline.wait():
+		return data, os.ErrDeadlineExceeded
+	case <-ctx.Done():
+		return data, ctx.Err()
+	}
+}
+
+// ReadBatch like ReadFromUDPAddrPort, but fills as many messages as are
+// queued, waiting only for the first one
+func (t *Tunat) ReadBatch(messages []UDPMessage) (n int, err error) {
+	if len(messages) == 0 {
+		return
+	}
+	data, err := t.receiveUDP(context.Background(), nil, &t.readDeadline)
+	for err == nil {
+		message := &messages[n]
+		message.N = copy(message.Payload, data.payload)
+		message.Source = data.saddr
+		message.Destination = data.daddr
+		t.releaseUDP(data)
+		n++
+		if n == len(messages) {
+			return
+		}
+
+		select {
+		case data = <-t.udpChan:
+		default:
+			return
+		}
+	}
+	return
+}
+
+// WriteBatch like WriteToUDPAddrPort for each message, returns the number of
+// messages written before the first error
+func (t *Tunat) WriteBatch(messages []UDPMessage) (n int, err error) {
+	for n = range messages {
+		_, err = t.WriteToUDPAddrPort(messages[n].Payload, messages[n].Source, messages[n].Destination)
+		if err != nil {
+			return
+		}
+	}
+	return len(messages), nil
+}
+
+// SetDeadline like net.PacketConn, for UDP read and write
+func (t *Tunat) SetDeadline(deadline time.Time) error {
+	if isClosedChan(t.closed) {
+		return net.ErrClosed
+	}
+	t.readDeadline.set(deadline)
+	t.writeDeadline.set(deadline)
+	return nil
+}
+
+// SetReadDeadline like net.PacketConn, for ReadFromUDPAddrPort
+func (t *Tunat) SetReadDeadline(deadline time.Time) error {
+	if isClosedChan(t.closed) {
+		return net.ErrClosed
+	}
+	t.readDeadline.set(deadline)
+	return nil
+}
+
+// SetWriteDeadline like net.PacketConn, for WriteToUDPAddrPort
+func (t *Tunat) SetWriteDeadline(deadline time.Time) error {
+	if isClosedChan(t.closed) {
+		return net.ErrClosed
+	}
+	t.writeDeadline.set(deadline)
+	return nil
 }
 
 // WriteToUDPAddrPort like net package
 func (t *Tunat) WriteToUDPAddrPort(payload []byte, saddr, daddr netip.AddrPort) (nwrite int, err error) {
+	if isClosedChan(t.writeDeadline.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return t.writeUDP(payload, saddr, daddr)
+}
+
+// writeUDP packets larger than the MTU are fragmented
+func (t *Tunat) writeUDP(payload []byte, saddr, daddr netip.AddrPort) (nwrite int, err error) {
 	if saddr.Addr().Is4() {
-		return t.ipv4WriteTo(payload, saddr, daddr)
+		if len(payload) > maxIPv4UDPPayload {
+			return 0, ErrPayloadTooLarge
+		}
+		err = t.ipv4WriteTo(payload, saddr, daddr)
+	} else {
+		if len(payload) > maxIPv6UDPPayload {
+			return 0, ErrPayloadTooLarge
+		}
+		err = t.ipv6WriteTo(payload, saddr, daddr)
 	}
-	return t.ipv6WriteTo(payload, saddr, daddr)
+	if err != nil {
+		return
+	}
+	return len(payload), nil
 }
 
-func (t *Tunat) ipv4WriteTo(payload []byte, saddr, daddr netip.AddrPort) (nwrite int, err error) {
+func (t *Tunat) ipv4WriteTo(payload []byte, saddr, daddr netip.AddrPort) error {
 	totalLen := header.IPv4MinimumSize + header.UDPMinimumSize + len(payload)
-	ipHeader := header.IPv4(
-		append(
-			make([]byte, totalLen-len(payload)),
-			payload...,
-		),
-	)
+	buf := t.buffers.get(totalLen)
+	defer t.buffers.put(buf)
+	ipHeader := header.IPv4(*buf)
+	copy(ipHeader[totalLen-len(payload):], payload)
 	ipHeader.Encode(&header.IPv4Fields{
 		TotalLength: uint16(totalLen),
 		TTL:         64,
@@ -67,17 +251,15 @@ func (t *Tunat) ipv4WriteTo(payload []byte, saddr, daddr netip.AddrPort) (nwrite
 		),
 	)
 
-	return t.file.Write(ipHeader)
+	return t.writeIPv4(ipHeader)
 }
 
-func (t *Tunat) ipv6WriteTo(payload []byte, saddr, daddr netip.AddrPort) (nwrite int, err error) {
+func (t *Tunat) ipv6WriteTo(payload []byte, saddr, daddr netip.AddrPort) error {
 	totalLen := header.IPv6MinimumSize + header.UDPMinimumSize + len(payload)
-	ipHeader := header.IPv6(
-		append(
-			make([]byte, totalLen-len(payload)),
-			payload...,
-		),
-	)
+	buf := t.buffers.get(totalLen)
+	defer t.buffers.put(buf)
+	ipHeader := header.IPv6(*buf)
+	copy(ipHeader[totalLen-len(payload):], payload)
 	ipHeader.Encode(&header.IPv6Fields{
 		PayloadLength:     uint16(header.UDPMinimumSize + len(payload)),
 		TransportProtocol: header.UDPProtocolNumber,
@@ -107,7 +289,7 @@ func (t *Tunat) ipv6WriteTo(payload []byte, saddr, daddr netip.AddrPort) (nwrite
 		),
 	)
 
-	return t.file.Write(ipHeader)
+	return t.writeIPv6(ipHeader)
 }
 
 func (t *Tunat) handleIPv4UDP(ipHeader header.IPv4, udpHeader header.UDP) {
@@ -122,11 +304,17 @@ func (t *Tunat) handleIPv4UDP(ipHeader header.IPv4, udpHeader header.UDP) {
 	}
 	daddr := netip.AddrPortFrom(ip, udpHeader.DestinationPort())
 
-	t.udpChan <- udpData{
-		payload: append([]byte(nil), udpHeader.Payload()...),
+	buf := t.buffers.get(len(udpHeader.Payload()))
+	data := udpData{
+		payload: (*buf)[:copy(*buf, udpHeader.Payload())],
+		buf:     buf,
 		saddr:   saddr,
 		daddr:   daddr,
 	}
+	if t.dispatchUDP(data) {
+		return
+	}
+	t.queueUDP(t.udpChan, data)
 }
 
 func (t *Tunat) handleIPv6UDP(ipHeader header.IPv6, udpHeader header.UDP) {
@@ -141,9 +329,15 @@ func (t *Tunat) handleIPv6UDP(ipHeader header.IPv6, udpHeader header.UDP) {
 	}
 	daddr := netip.AddrPortFrom(ip, udpHeader.DestinationPort())
 
-	t.udpChan <- udpData{
-		payload: append([]byte(nil), udpHeader.Payload()...),
+	buf := t.buffers.get(len(udpHeader.Payload()))
+	data := udpData{
+		payload: (*buf)[:copy(*buf, udpHeader.Payload())],
+		buf:     buf,
 		saddr:   saddr,
 		daddr:   daddr,
 	}
+	if t.dispatchUDP(data) {
+		return
+	}
+	t.queueUDP(t.udpChan, data)
 }
@@ -0,0 +1,80 @@
+package tunat
+
+import (
+	"net/netip"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// discardDevice drop every written packet
+type discardDevice struct{}
+
+func (discardDevice) Read(buf []byte) (int, error) { select {} }
+
+func (discardDevice) Write(buf []byte) (int, error) { return len(buf), nil }
+
+func (discardDevice) Close() error { return nil }
+
+func TestBatch(t *testing.T) {
+	tn, dev := newTestTunat(t)
+	saddr := netip.MustParseAddrPort("10.0.0.1:1234")
+	daddr := netip.MustParseAddrPort("1.2.3.4:443")
+
+	messages := make([]UDPMessage, 4)
+	for i := range messages {
+		messages[i] = UDPMessage{
+			Payload:     []byte{byte(i)},
+			Source:      daddr,
+			Destination: saddr,
+		}
+	}
+	if n, err := tn.WriteBatch(messages[:3]); n != 3 || err != nil {
+		t.Fatalf("wrote %d %v", n, err)
+	}
+	for i := 0; i < 3; i++ {
+		packet := readPacket(t, dev)
+		_, _ = dev.Write(buildUDP(saddr, daddr, header.UDP(header.IPv4(packet).Payload()).Payload()))
+	}
+
+	// wait for the first message, then take what is queued
+	var n int
+	for n < 3 {
+		nread, err := tn.ReadBatch(messages[n:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += nread
+	}
+	for i, message := range messages[:n] {
+		if message.N != 1 || message.Payload[0] != byte(i) || message.Source != saddr || message.Destination != daddr {
+			t.Fatalf("message %d: %+v", i, message)
+		}
+	}
+}
+
+func BenchmarkUDPRead(b *testing.B) {
+	tn, _ := newTestTunat(b)
+	packet := header.IPv4(buildUDP(netip.MustParseAddrPort("10.0.0.1:1234"), netip.MustParseAddrPort("1.2.3.4:443"), make([]byte, 1200)))
+	buf := make([]byte, 1500)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tn.handleIPv4UDP(packet, packet.Payload())
+		_, _, _, _ = tn.ReadFromUDPAddrPort(buf)
+	}
+}
+
+func BenchmarkUDPWrite(b *testing.B) {
+	tn := &Tunat{file: discardDevice{}, bufLen: 1500, buffers: newBufferPool(1500)}
+	saddr := netip.MustParseAddrPort("1.2.3.4:443")
+	daddr := netip.MustParseAddrPort("10.0.0.1:1234")
+	payload := make([]byte, 1200)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = tn.WriteToUDPAddrPort(payload, saddr, daddr)
+	}
+}
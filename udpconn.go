@@ -0,0 +1,144 @@
+package tunat
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// udpConnMaxDestinations bound the memory used to remember original
+// destinations for WriteTo
+const udpConnMaxDestinations = 65536
+
+// UDPConn net.PacketConn over ReadFromUDPAddrPort and WriteToUDPAddrPort.
+// WriteTo replies from the original destination the peer last sent to,
+// ReadFromUDPAddrPort and WriteToUDPAddrPort expose it explicitly
+type UDPConn struct {
+	tunat         *Tunat
+	readDeadline  deadline
+	writeDeadline deadline
+	closed        chan struct{}
+	closeOnce     sync.Once
+
+	mutex        sync.Mutex
+	destinations map[netip.AddrPort]netip.AddrPort // saddr -> daddr
+}
+
+var _ net.PacketConn = (*UDPConn)(nil)
+
+// UDPConn new a net.PacketConn view, closing it does not close Tunat
+func (t *Tunat) UDPConn() *UDPConn {
+	return &UDPConn{
+		tunat:         t,
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+		closed:        make(chan struct{}),
+		destinations:  make(map[netip.AddrPort]netip.AddrPort),
+	}
+}
+
+// ReadFrom like net.PacketConn, addr is the original source
+func (c *UDPConn) ReadFrom(payload []byte) (nread int, addr net.Addr, err error) {
+	nread, saddr, _, err := c.ReadFromUDPAddrPort(payload)
+	if err != nil {
+		return
+	}
+	return nread, net.UDPAddrFromAddrPort(saddr), nil
+}
+
+// ReadFromUDPAddrPort like Tunat.ReadFromUDPAddrPort
+func (c *UDPConn) ReadFromUDPAddrPort(payload []byte) (nread int, saddr, daddr netip.AddrPort, err error) {
+	nread, saddr, daddr, err = c.tunat.readUDP(context.Background(), payload, c.closed, &c.readDeadline)
+	if err != nil {
+		return
+	}
+
+	c.mutex.Lock()
+	if _, ok := c.destinations[saddr]; !ok && len(c.destinations) >= udpConnMaxDestinations {
+		for key := range c.destinations {
+			delete(c.destinations, key)
+			break
+		}
+	}
+	c.destinations[saddr] = daddr
+	c.mutex.Unlock()
+	return
+}
+
+// WriteTo like net.PacketConn, addr is an original source returned by
+// ReadFrom
+func (c *UDPConn) WriteTo(payload []byte, addr net.Addr) (nwrite int, err error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: addr, Err: net.InvalidAddrError("not a UDP address")}
+	}
+	daddr := udpAddr.AddrPort()
+	daddr = netip.AddrPortFrom(daddr.Addr().Unmap(), daddr.Port())
+
+	c.mutex.Lock()
+	saddr, ok := c.destinations[daddr]
+	c.mutex.Unlock()
+	if !ok {
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: addr, Err: errors.New("no original destination for this address")}
+	}
+	return c.WriteToUDPAddrPort(payload, saddr, daddr)
+}
+
+// WriteToUDPAddrPort like Tunat.WriteToUDPAddrPort
+func (c *UDPConn) WriteToUDPAddrPort(payload []byte, saddr, daddr netip.AddrPort) (nwrite int, err error) {
+	if isClosedChan(c.closed) {
+		return 0, net.ErrClosed
+	}
+	if isClosedChan(c.writeDeadline.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return c.tunat.writeUDP(payload, saddr, daddr)
+}
+
+// Close only this view
+func (c *UDPConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+// LocalAddr address of the tun device
+func (c *UDPConn) LocalAddr() net.Addr {
+	if c.tunat.ipv4TCPListenerAddrPort.IsValid() {
+		return &net.UDPAddr{IP: c.tunat.ipv4TCPListenerAddrPort.Addr().AsSlice()}
+	}
+	return &net.UDPAddr{IP: c.tunat.ipv6TCPListenerAddrPort.Addr().AsSlice()}
+}
+
+// SetDeadline like net.PacketConn
+func (c *UDPConn) SetDeadline(deadline time.Time) error {
+	if isClosedChan(c.closed) {
+		return net.ErrClosed
+	}
+	c.readDeadline.set(deadline)
+	c.writeDeadline.set(deadline)
+	return nil
+}
+
+// SetReadDeadline like net.PacketConn
+func (c *UDPConn) SetReadDeadline(deadline time.Time) error {
+	if isClosedChan(c.closed) {
+		return net.ErrClosed
+	}
+	c.readDeadline.set(deadline)
+	return nil
+}
+
+// SetWriteDeadline like net.PacketConn
+func (c *UDPConn) SetWriteDeadline(deadline time.Time) error {
+	if isClosedChan(c.closed) {
+		return net.ErrClosed
+	}
+	c.writeDeadline.set(deadline)
+	return nil
+}
@@ -0,0 +1,244 @@
+package tunat
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultUDPSessionTimeout default idle timeout of UDP sessions
+const DefaultUDPSessionTimeout = time.Minute
+
+// DefaultMaxUDPSessions default capacity of the UDP session table
+const DefaultMaxUDPSessions = 1 << 14
+
+type udpFlow struct {
+	saddr netip.AddrPort
+	daddr netip.AddrPort
+}
+
+// UDPSession one UDP flow returned by AcceptUDP, Read returns the payloads
+// the original source sent to the original destination, Write replies from
+// the original destination
+type UDPSession struct {
+	tunat          *Tunat
+	flow           udpFlow
+	saddrInterface net.Addr
+	daddrInterface net.Addr
+	packets        chan udpData
+	readDeadline   deadline
+	writeDeadline  deadline
+	closed         chan struct{}
+	closeOnce      sync.Once
+	lastSeen       time.Time // protected by the udpSessionTable mutex
+}
+
+var _ net.Conn = (*UDPSession)(nil)
+
+// udpSessionTable sessions by flow, used once AcceptUDP is called
+type udpSessionTable struct {
+	enabled    uint32
+	mutex      sync.Mutex
+	sessions   map[udpFlow]*UDPSession
+	max        int
+	timeout    time.Duration
+	queueSize  int
+	acceptChan chan *UDPSession
+}
+
+func newUDPSessionTable(max int, timeout time.Duration, queueSize int) *udpSessionTable {
+	return &udpSessionTable{
+		sessions:   make(map[udpFlow]*UDPSession),
+		max:        max,
+		timeout:    timeout,
+		queueSize:  queueSize,
+		acceptChan: make(chan *UDPSession, queueSize),
+	}
+}
+
+// AcceptUDP like Accept, one UDPSession per flow. Once it is called, UDP
+// packets go to sessions instead of ReadFromUDPAddrPort
+func (t *Tunat) AcceptUDP() (session *UDPSession, err error) {
+	return t.AcceptUDPContext(context.Background())
+}
+
+// AcceptUDPContext like AcceptUDP, but returns ctx.Err() once ctx is done
+func (t *Tunat) AcceptUDPContext(ctx context.Context) (session *UDPSession, err error) {
+	atomic.StoreUint32(&t.udpSessions.enabled, 1)
+
+	select {
+	case session = <-t.udpSessions.acceptChan:
+		return session, nil
+	case <-t.closed:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dispatchUDP ok if the packet is handled by the session table
+func (t *Tunat) dispatchUDP(data udpData) (ok bool) {
+	table := t.udpSessions
+	if atomic.LoadUint32(&table.enabled) == 0 {
+		return false
+	}
+	flow := udpFlow{data.saddr, data.daddr}
+
+	table.mutex.Lock()
+	session, ok := table.sessions[flow]
+	if !ok {
+		if len(table.sessions) >= table.max {
+			table.mutex.Unlock()
+			atomic.AddUint64(&t.stats.DroppedUDPSessions, 1)
+			t.releaseUDP(data)
+			return true
+		}
+		session = t.newUDPSession(flow)
+		select {
+		case table.acceptChan <- session:
+		default:
+			table.mutex.Unlock()
+			atomic.AddUint64(&t.stats.DroppedUDPSessions, 1)
+			t.releaseUDP(data)
+			return true
+		}
+		table.sessions[flow] = session
+	}
+	session.lastSeen = time.Now()
+	table.mutex.Unlock()
+
+	t.queueUDP(session.packets, data)
+	return true
+}
+
+func (t *Tunat) newUDPSession(flow udpFlow) *UDPSession {
+	return &UDPSession{
+		tunat:          t,
+		flow:           flow,
+		saddrInterface: net.UDPAddrFromAddrPort(flow.saddr),
+		daddrInterface: net.UDPAddrFromAddrPort(flow.daddr),
+		packets:        make(chan udpData, t.udpSessions.queueSize),
+		readDeadline:   makeDeadline(),
+		writeDeadline:  makeDeadline(),
+		closed:         make(chan struct{}),
+	}
+}
+
+// gcUDP close idle sessions
+func (t *Tunat) gcUDP(now time.Time) {
+	table := t.udpSessions
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	for flow, session := range table.sessions {
+		if now.Sub(session.lastSeen) > table.timeout {
+			delete(table.sessions, flow)
+			session.closeOnce.Do(func() {
+				close(session.closed)
+			})
+		}
+	}
+}
+
+// Read one payload from the original source
+func (s *UDPSession) Read(payload []byte) (nread int, err error) {
+	select {
+	case <-s.closed:
+		return 0, net.ErrClosed
+	case <-s.tunat.closed:
+		return 0, net.ErrClosed
+	case <-s.readDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	select {
+	case data := <-s.packets:
+		nread = copy(payload, data.payload)
+		s.tunat.releaseUDP(data)
+		return nread, nil
+	case <-s.closed:
+		return 0, net.ErrClosed
+	case <-s.tunat.closed:
+		return 0, net.ErrClosed
+	case <-s.readDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+// Write one payload to the original source, from the original destination
+func (s *UDPSession) Write(payload []byte) (nwrite int, err error) {
+	if isClosedChan(s.closed) || isClosedChan(s.tunat.closed) {
+		return 0, net.ErrClosed
+	}
+	if isClosedChan(s.writeDeadline.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	_, err = s.tunat.writeUDP(payload, s.flow.daddr, s.flow.saddr)
+	if err != nil {
+		return
+	}
+
+	table := s.tunat.udpSessions
+	table.mutex.Lock()
+	s.lastSeen = time.Now()
+	table.mutex.Unlock()
+	return len(payload), nil
+}
+
+// Close remove the session, a later packet of the flow starts a new session
+func (s *UDPSession) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+
+	table := s.tunat.udpSessions
+	table.mutex.Lock()
+	if table.sessions[s.flow] == s {
+		delete(table.sessions, s.flow)
+	}
+	table.mutex.Unlock()
+	return nil
+}
+
+// LocalAddr original destination address
+func (s *UDPSession) LocalAddr() net.Addr {
+	return s.daddrInterface
+}
+
+// RemoteAddr original source address
+func (s *UDPSession) RemoteAddr() net.Addr {
+	return s.saddrInterface
+}
+
+// SetDeadline like net.Conn
+func (s *UDPSession) SetDeadline(deadline time.Time) error {
+	if isClosedChan(s.closed) {
+		return net.ErrClosed
+	}
+	s.readDeadline.set(deadline)
+	s.writeDeadline.set(deadline)
+	return nil
+}
+
+// SetReadDeadline like net.Conn
+func (s *UDPSession) SetReadDeadline(deadline time.Time) error {
+	if isClosedChan(s.closed) {
+		return net.ErrClosed
+	}
+	s.readDeadline.set(deadline)
+	return nil
+}
+
+// SetWriteDeadline like net.Conn
+func (s *UDPSession) SetWriteDeadline(deadline time.Time) error {
+	if isClosedChan(s.closed) {
+		return net.ErrClosed
+	}
+	s.writeDeadline.set(deadline)
+	return nil
+}
@@ -0,0 +1,79 @@
+package tunat
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+func TestUDPSession(t *testing.T) {
+	tn, dev := newTunatWithOptions(t, WithMaxUDPSessions(2))
+	saddr := netip.MustParseAddrPort("10.0.0.1:1234")
+	daddr := netip.MustParseAddrPort("1.2.3.4:53")
+
+	acceptUDP := func() *UDPSession {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		session, err := tn.AcceptUDPContext(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return session
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := tn.AcceptUDPContext(ctx); err != context.Canceled {
+		t.Fatalf("want context.Canceled, got %v", err)
+	}
+
+	// one session per flow
+	_, _ = dev.Write(buildUDP(saddr, daddr, []byte("first")))
+	_, _ = dev.Write(buildUDP(saddr, daddr, []byte("second")))
+	_, _ = dev.Write(buildUDP(saddr, netip.MustParseAddrPort("1.2.3.4:54"), []byte("other")))
+	session := acceptUDP()
+	if session.RemoteAddr().String() != saddr.String() || session.LocalAddr().String() != daddr.String() {
+		t.Fatalf("session %v -> %v", session.RemoteAddr(), session.LocalAddr())
+	}
+	buf := make([]byte, 100)
+	for _, want := range []string{"first", "second"} {
+		nread, err := session.Read(buf)
+		if err != nil || string(buf[:nread]) != want {
+			t.Fatalf("read %q %v", buf[:nread], err)
+		}
+	}
+	other := acceptUDP()
+
+	// replies come from the original destination
+	if _, err := session.Write([]byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	ipHeader := header.IPv4(readPacket(t, dev))
+	udpHeader := header.UDP(ipHeader.Payload())
+	if string(ipHeader.SourceAddress()) != string(daddr.Addr().AsSlice()) || udpHeader.SourcePort() != daddr.Port() ||
+		udpHeader.DestinationPort() != saddr.Port() || string(udpHeader.Payload()) != "reply" {
+		t.Fatalf("reply %v:%v -> %v", ipHeader.SourceAddress(), udpHeader.SourcePort(), udpHeader.DestinationPort())
+	}
+
+	// the table is full
+	_, _ = dev.Write(buildUDP(netip.MustParseAddrPort("10.0.0.1:1235"), daddr, []byte("dropped")))
+	time.Sleep(10 * time.Millisecond)
+	if stats := tn.Stats(); stats.DroppedUDPSessions != 1 {
+		t.Fatalf("%d dropped sessions", stats.DroppedUDPSessions)
+	}
+
+	// idle sessions are closed, closed sessions leave the table
+	tn.gcUDP(time.Now().Add(DefaultUDPSessionTimeout / 2))
+	other.Close()
+	tn.gcUDP(time.Now().Add(DefaultUDPSessionTimeout * 2))
+	if _, err := session.Read(buf); err != net.ErrClosed {
+		t.Fatalf("want net.ErrClosed, got %v", err)
+	}
+	if len(tn.udpSessions.sessions) != 0 {
+		t.Fatalf("%d sessions left", len(tn.udpSessions.sessions))
+	}
+}
@@ -0,0 +1,91 @@
+package tunat
+
+import (
+	"sync/atomic"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// validateIPv4 returns the packet trimmed to its total length
+func (t *Tunat) validateIPv4(packet []byte) (ipHeader header.IPv4, ok bool) {
+	if len(packet) < header.IPv4MinimumSize {
+		atomic.AddUint64(&t.stats.DroppedShortHeader, 1)
+		return
+	}
+	ipHeader = header.IPv4(packet)
+	headerLen := int(ipHeader.HeaderLength())
+	if headerLen < header.IPv4MinimumSize || headerLen > len(packet) {
+		atomic.AddUint64(&t.stats.DroppedBadHeaderLength, 1)
+		return nil, false
+	}
+	totalLen := int(ipHeader.TotalLength())
+	if totalLen < headerLen || totalLen > len(packet) {
+		atomic.AddUint64(&t.stats.DroppedBadLength, 1)
+		return nil, false
+	}
+	if t.verifyChecksums && !ipHeader.IsChecksumValid() {
+		atomic.AddUint64(&t.stats.DroppedBadChecksum, 1)
+		return nil, false
+	}
+	return ipHeader[:totalLen], true
+}
+
+// validateIPv6 returns the packet trimmed to its payload length, the
+// extension headers are checked by ipv6Transport
+func (t *Tunat) validateIPv6(packet []byte) (ipHeader header.IPv6, ok bool) {
+	if len(packet) < header.IPv6MinimumSize {
+		atomic.AddUint64(&t.stats.DroppedShortHeader, 1)
+		return
+	}
+	ipHeader = header.IPv6(packet)
+	totalLen := header.IPv6MinimumSize + int(ipHeader.PayloadLength())
+	if totalLen > len(packet) {
+		atomic.AddUint64(&t.stats.DroppedBadLength, 1)
+		return nil, false
+	}
+	return ipHeader[:totalLen], true
+}
+
+// validateTCP src and dst are only used to verify the checksum, which is
+// skipped if it is partial
+func (t *Tunat) validateTCP(tcpHeader header.TCP, src, dst tcpip.Address, partial bool) (ok bool) {
+	if len(tcpHeader) < header.TCPMinimumSize {
+		atomic.AddUint64(&t.stats.DroppedShortHeader, 1)
+		return false
+	}
+	dataOffset := int(tcpHeader.DataOffset())
+	if dataOffset < header.TCPMinimumSize || dataOffset > len(tcpHeader) {
+		atomic.AddUint64(&t.stats.DroppedBadHeaderLength, 1)
+		return false
+	}
+	if t.verifyChecksums && !partial && !tcpHeader.IsChecksumValid(src, dst,
+		header.Checksum(tcpHeader.Payload(), 0),
+		uint16(len(tcpHeader.Payload())),
+	) {
+		atomic.AddUint64(&t.stats.DroppedBadChecksum, 1)
+		return false
+	}
+	return true
+}
+
+// validateUDP returns the datagram trimmed to its length, a zero checksum
+// is only allowed over ipv4
+func (t *Tunat) validateUDP(udpHeader header.UDP, src, dst tcpip.Address, partial bool) (header.UDP, bool) {
+	if len(udpHeader) < header.UDPMinimumSize {
+		atomic.AddUint64(&t.stats.DroppedShortHeader, 1)
+		return nil, false
+	}
+	length := int(udpHeader.Length())
+	if length < header.UDPMinimumSize || length > len(udpHeader) {
+		atomic.AddUint64(&t.stats.DroppedBadLength, 1)
+		return nil, false
+	}
+	udpHeader = udpHeader[:length]
+	if t.verifyChecksums && !partial && (udpHeader.Checksum() != 0 || len(src) == header.IPv6AddressSize) &&
+		!udpHeader.IsChecksumValid(src, dst, header.Checksum(udpHeader.Payload(), 0)) {
+		atomic.AddUint64(&t.stats.DroppedBadChecksum, 1)
+		return nil, false
+	}
+	return udpHeader, true
+}
@@ -0,0 +1,82 @@
+package tunat
+
+import (
+	"net/netip"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+func TestValidate(t *testing.T) {
+	tn, _ := newTunatWithOptions(t, WithVerifyChecksums(true))
+	saddr := netip.MustParseAddrPort("10.0.0.1:1234")
+	daddr := netip.MustParseAddrPort("1.2.3.4:80")
+	saddr6 := netip.MustParseAddrPort("[fd::1]:1234")
+	daddr6 := netip.MustParseAddrPort("[2001:db8::1]:80")
+
+	for _, tt := range []struct {
+		name    string
+		packet  func() []byte
+		counter func(Stats) uint64
+	}{
+		{"ipv4 short header", func() []byte {
+			return buildUDP(saddr, daddr, nil)[:header.IPv4MinimumSize-1]
+		}, func(s Stats) uint64 { return s.DroppedShortHeader }},
+		{"ipv4 bad ihl", func() []byte {
+			packet := buildUDP(saddr, daddr, nil)
+			packet[0] = 0x44
+			return packet
+		}, func(s Stats) uint64 { return s.DroppedBadHeaderLength }},
+		{"ipv4 bad total length", func() []byte {
+			return buildUDP(saddr, daddr, []byte("abcd"))[:header.IPv4MinimumSize+header.UDPMinimumSize]
+		}, func(s Stats) uint64 { return s.DroppedBadLength }},
+		{"tcp short header", func() []byte {
+			packet := header.IPv4(buildTCP(saddr, daddr, header.TCPFlagSyn, nil))
+			packet.SetTotalLength(header.IPv4MinimumSize + 10)
+			packet.SetChecksum(0)
+			packet.SetChecksum(^packet.CalculateChecksum())
+			return packet
+		}, func(s Stats) uint64 { return s.DroppedShortHeader }},
+		{"tcp bad data offset", func() []byte {
+			packet := buildTCP(saddr, daddr, header.TCPFlagSyn, nil)
+			packet[header.IPv4MinimumSize+12] = 0xf0
+			return packet
+		}, func(s Stats) uint64 { return s.DroppedBadHeaderLength }},
+		{"udp bad length", func() []byte {
+			packet := buildUDP(saddr, daddr, []byte("abcd"))
+			header.UDP(packet[header.IPv4MinimumSize:]).SetLength(100)
+			return packet
+		}, func(s Stats) uint64 { return s.DroppedBadLength }},
+		{"udp bad checksum", func() []byte {
+			packet := buildUDP(saddr, daddr, []byte("abcd"))
+			packet[len(packet)-1]++
+			return packet
+		}, func(s Stats) uint64 { return s.DroppedBadChecksum }},
+		{"ipv6 short header", func() []byte {
+			return buildUDP(saddr6, daddr6, nil)[:header.IPv6MinimumSize-1]
+		}, func(s Stats) uint64 { return s.DroppedShortHeader }},
+		{"ipv6 bad payload length", func() []byte {
+			packet := buildUDP(saddr6, daddr6, nil)
+			header.IPv6(packet).SetPayloadLength(100)
+			return packet
+		}, func(s Stats) uint64 { return s.DroppedBadLength }},
+		{"ipv6 extension header overrun", func() []byte {
+			packet := withExtensionHeaders(buildUDP(saddr6, daddr6, nil))
+			packet[header.IPv6MinimumSize+1] = 10
+			return packet
+		}, func(s Stats) uint64 { return s.DroppedBadLength }},
+		{"tcp bad checksum", func() []byte {
+			packet := buildTCP(saddr6, daddr6, header.TCPFlagSyn, []byte("abcd"))
+			packet[len(packet)-1]++
+			return packet
+		}, func(s Stats) uint64 { return s.DroppedBadChecksum }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			before := tt.counter(tn.Stats())
+			tn.handlePacket(tt.packet(), nil)
+			if tt.counter(tn.Stats()) != before+1 {
+				t.Fatal("not dropped")
+			}
+		})
+	}
+}